@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 
 	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/failover"
+	"github.com/awnumar/rosen/logging"
 	"github.com/awnumar/rosen/protocols/https"
 	"github.com/awnumar/rosen/protocols/tcp"
 	"github.com/awnumar/rosen/router"
@@ -13,23 +17,14 @@ import (
 	"github.com/eahydra/socks"
 )
 
-func client(conf config.Configuration) (err error) {
-	var client router.Client
-
-	switch conf["protocol"] {
-	case "":
-		return errors.New("protocol must be specified in config file")
-	case "tcp":
-		client, err = tcp.NewClient(conf)
-	case "https":
-		client, err = https.NewClient(conf)
-	default:
-		return errors.New("unknown protocol: " + conf["protocol"])
-	}
+func client(ctx context.Context, conf *config.Configuration) (err error) {
+	client, err := startClient(conf, logger, false)
 	if err != nil {
 		return err
 	}
 
+	serveControl(ctx, client)
+
 	dialer, err := newDialer(client)
 	if err != nil {
 		return err
@@ -45,7 +40,58 @@ func client(conf config.Configuration) (err error) {
 		return err
 	}
 
-	return s.Serve(listener)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+		listener.Close() // stop accepting new streams
+		return shutdown(client)
+	}
+}
+
+// startClient starts a client of the server that conf names, or of one of them if it lists several, and logs the
+// changes in the state of its session. If restart is set, a client of a single server is started again when its
+// session fails, as it is when there are several.
+func startClient(conf *config.Configuration, logger *slog.Logger, restart bool) (router.Client, error) {
+	newClient := func(conf *config.Configuration) (router.Client, error) {
+		switch conf.Protocol {
+		case "tcp":
+			return tcp.NewClient(conf, logger)
+		case "https":
+			return https.NewClient(conf, logger)
+		default:
+			return nil, errors.New("unknown protocol: " + conf.Protocol)
+		}
+	}
+
+	var client router.Client
+	var err error
+	if len(conf.Servers) > 0 || restart {
+		client, err = failover.NewClient(conf, newClient, failover.WithLogger(logger))
+	} else {
+		client, err = newClient(conf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if notifier, ok := client.(router.StateNotifier); ok {
+		go func() {
+			for change := range notifier.StateChanges() {
+				if change.Err != nil {
+					logger.Warn("connection "+change.State.String(), logging.Err(change.Err))
+				} else {
+					logger.Info("connection " + change.State.String())
+				}
+			}
+		}()
+	}
+	return client, nil
 }
 
 type dialer struct {
@@ -95,7 +141,7 @@ func (d *dialer) Dial(network, address string) (net.Conn, error) {
 		return nil, err
 	case serverConn := <-connChannel:
 		if err := d.tun.HandleConnection(router.NewEndpoint(network, address), serverConn); err != nil {
-			fmt.Println(err)
+			logger.Warn("failed to open stream", logging.Dest(address), logging.Err(err))
 		}
 	}
 
@@ -0,0 +1,64 @@
+package config
+
+import "reflect"
+
+// Changes returns the paths of the values that differ between two configurations, in the form used by FieldError,
+// for example users or https.decoy. Servers use it to tell which parts of a reloaded configuration they can apply.
+func Changes(old, new *Configuration) []string {
+	var changed []string
+	if old.Role != new.Role {
+		changed = append(changed, "role")
+	}
+	if old.Protocol != new.Protocol {
+		return append(changed, "protocol") // the sections cannot be compared
+	}
+	if old.AuthToken != new.AuthToken {
+		changed = append(changed, "authToken")
+	}
+	if !reflect.DeepEqual(old.Users, new.Users) {
+		changed = append(changed, "users")
+	}
+	if !reflect.DeepEqual(old.Limits, new.Limits) {
+		changed = append(changed, "limits")
+	}
+	if old.UsageFile != new.UsageFile {
+		changed = append(changed, "usageFile")
+	}
+	if !reflect.DeepEqual(old.Priorities, new.Priorities) {
+		changed = append(changed, "priorities")
+	}
+	if !reflect.DeepEqual(old.Keepalive, new.Keepalive) {
+		changed = append(changed, "keepalive")
+	}
+	if !reflect.DeepEqual(old.Upstream, new.Upstream) {
+		changed = append(changed, "upstream")
+	}
+	if !reflect.DeepEqual(old.Dial, new.Dial) {
+		changed = append(changed, "dial")
+	}
+
+	spec, err := specFor(old.Protocol)
+	if err != nil {
+		return changed
+	}
+	oldValues, _ := toValues(old.section())
+	newValues, _ := toValues(new.section())
+	for _, o := range spec.options {
+		if oldValues[o.key] != newValues[o.key] {
+			changed = append(changed, spec.protocol+"."+o.key)
+		}
+	}
+	return changed
+}
+
+// RestartRequired returns the changes between the configuration that a server was started with and a reloaded one
+// that the server cannot apply while running, given the paths of the values that it can.
+func RestartRequired(started, reloaded *Configuration, reloadable []string) []string {
+	var restart []string
+	for _, change := range Changes(started, reloaded) {
+		if !contains(reloadable, change) {
+			restart = append(restart, change)
+		}
+	}
+	return restart
+}
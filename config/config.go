@@ -1,108 +1,251 @@
 package config
 
 import (
-	"bufio"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"os"
 	"strings"
-
-	"github.com/fatih/color"
 )
 
 var protocols = []string{"https", "tcp"}
 
 // Specification is a set of config values for a protocol. One needs to be defined per supported protocol.
+// If finalise is set, it is called once all options have been answered and may fill in derived values.
 type specification struct {
 	protocol string
 	options  []option
+	finalise func(values) error
 }
 
 // Option represents a configuration value that we will ask the user for.
+// If condition is set, the option only applies when it returns true for the values chosen so far.
+// Options without a prompt are derived rather than asked for, but they are still verified.
 type option struct {
-	key     string
-	prompt  string
-	process func(string) (string, error)
+	key       string
+	prompt    string
+	process   func(string) (string, error)
+	condition func(values) bool
+
+	// serverOnly options are left out of client configurations.
+	// Server configurations hold every option, so that client configurations can be generated from them.
+	serverOnly bool
 }
 
+func (o option) applies(v values) bool {
+	return o.condition == nil || o.condition(v)
+}
+
+// belongsTo reports whether the option is part of a configuration with the given role.
+func (o option) belongsTo(role string) bool {
+	return !(o.serverOnly && role == "client")
+}
+
+// values holds the options of a protocol as strings, in the form that they are entered by the user.
+type values map[string]string
+
 // Configuration represents a set of chosen options.
-type Configuration map[string]string
+// Exactly one of the protocol sections is set, according to Protocol.
+type Configuration struct {
+	Role      string       `json:"role,omitempty"`
+	Protocol  string       `json:"protocol"`
+	AuthToken string       `json:"authToken"`
+	HTTPS     *HTTPSConfig `json:"https,omitempty"`
+	TCP       *TCPConfig   `json:"tcp,omitempty"`
+
+	// Users holds the named clients of a server, in addition to the one that authenticates with AuthToken.
+	Users []User `json:"users,omitempty"`
+
+	// Limits caps the throughput and traffic of a server.
+	Limits *Limits `json:"limits,omitempty"`
+
+	// UsageFile is where a server keeps the traffic of each user.
+	UsageFile string `json:"usageFile,omitempty"`
+
+	// Priorities weighs the share of the tunnel that streams get when it is busy, by the port of their destination,
+	// for example {"22": 8} so that SSH sessions stay responsive during downloads.
+	Priorities map[string]int `json:"priorities,omitempty"`
+
+	// Keepalive sets how tcp tunnels detect that the remote end has gone away.
+	Keepalive *Keepalive `json:"keepalive,omitempty"`
+
+	// Servers lists other servers that a client can switch to when the one above fails, possibly with different
+	// protocols. Selection is how the client chooses between them: by priority (the default) or by latency.
+	Servers   []Server `json:"servers,omitempty"`
+	Selection string   `json:"selection,omitempty"`
+
+	// Upstream chains a server to another: the streams of its users are opened through the next server, as a client
+	// with this configuration, instead of by connecting to their destinations directly.
+	Upstream *Configuration `json:"upstream,omitempty"`
+
+	// Dial sets how a server connects to the destinations of streams, such as through a SOCKS5 proxy.
+	Dial *Dial `json:"dial,omitempty"`
+
+	// passphrase is set if the configuration was loaded from, or is to be written to, an encrypted file.
+	passphrase []byte
+}
+
+// HTTPSConfig holds the options of the https protocol.
+type HTTPSConfig struct {
+	ProxyAddr     string `json:"proxyAddr,omitempty"`
+	Hostname      string `json:"hostname,omitempty"`
+	PlainHTTP     bool   `json:"plainHTTP,omitempty"`
+	ListenAddr    string `json:"listenAddr,omitempty"`
+	RedirectAddr  string `json:"redirectAddr,omitempty"`
+	ProxyProtocol bool   `json:"proxyProtocol,omitempty"`
+	CertSource    string `json:"certSource,omitempty"`
+	CertFile      string `json:"certFile,omitempty"`
+	KeyFile       string `json:"keyFile,omitempty"`
+	CADir         string `json:"caDir,omitempty"`
+	CAFingerprint string `json:"caFingerprint,omitempty"`
+	Email         string `json:"email,omitempty"`
+	PinRootCA     bool   `json:"pinRootCA,omitempty"`
+	Decoy         string `json:"decoy,omitempty"`
+	DecoyUpstream string `json:"decoyUpstream,omitempty"`
+	DecoyDir      string `json:"decoyDir,omitempty"`
+	TLSMaxVersion string `json:"tlsMaxVersion,omitempty"`
+	AuthLocation  string `json:"authLocation,omitempty"`
+	AuthName      string `json:"authName,omitempty"`
+}
+
+// TCPConfig holds the options of the tcp protocol.
+type TCPConfig struct {
+	ServerAddr string `json:"serverAddr,omitempty"`
+	ServerPort int    `json:"serverPort,omitempty"`
+	Tunnels    int    `json:"tunnels,omitempty"`
+}
+
+// FieldError is returned when a configuration value is invalid.
+// Field is the path of the value in the JSON representation, for example https.listenAddr.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return "config error: " + e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
 
 // JSON returns the prettified JSON representation of a configuration.
-func (c Configuration) JSON() ([]byte, error) {
+func (c *Configuration) JSON() ([]byte, error) {
 	return json.MarshalIndent(c, "", "	")
 }
 
-// Configure launches the quiz that asks the user for configuration values.
-// The resulting configuration is written to the working directory and the filename is returned.
-func Configure() (string, error) {
-	protocol := answer(fmt.Sprintf("Which protocol do you want to use?\nChoose from {%s}\n> ", strList(protocols)),
-		func(resp string) (string, error) {
-			if !contains(protocols, resp) {
-				return "", errors.New("invalid protocol")
-			}
-			return resp, nil
-		})
+// Verify checks every value in the configuration and fills in defaults for options that are not set.
+func (c *Configuration) Verify() error {
+	if c.Role != "" && c.Role != "server" && c.Role != "client" {
+		return &FieldError{"role", errors.New("must be server or client")}
+	}
+	if err := c.verifyUsers(); err != nil {
+		return err
+	}
+	if err := c.verifyLimits(); err != nil {
+		return err
+	}
+	if err := c.verifyPriorities(); err != nil {
+		return err
+	}
+	if err := c.verifyKeepalive(); err != nil {
+		return err
+	}
+	if err := c.verifyServers(); err != nil {
+		return err
+	}
+	if err := c.verifyUpstream(); err != nil {
+		return err
+	}
+	if err := c.verifyDial(); err != nil {
+		return err
+	}
 
-	switch protocol {
-	case "https":
-		return processSpec(https)
-	case "tcp":
-		return processSpec(tcp)
-	default:
-		panic("error: unknown protocol") // should never happen
+	spec, err := specFor(c.Protocol)
+	if err != nil {
+		return &FieldError{"protocol", err}
+	}
+	if c.Protocol != "https" && c.HTTPS != nil {
+		return &FieldError{"https", errors.New("must not be set when protocol is " + c.Protocol)}
+	}
+	if c.Protocol != "tcp" && c.TCP != nil {
+		return &FieldError{"tcp", errors.New("must not be set when protocol is " + c.Protocol)}
 	}
-}
 
-func verify(c Configuration) error {
-	var s specification
-	switch c["protocol"] {
-	case "https":
-		s = https
-	case "tcp":
-		s = tcp
-	default:
-		return errors.New("unknown protocol")
+	section := c.section()
+	v, err := toValues(section)
+	if err != nil {
+		return err
 	}
-	for _, o := range s.options {
-		if _, err := o.process(c[o.key]); err != nil {
-			return errors.New("config error: " + o.key + " " + err.Error())
+	for _, o := range spec.options {
+		if !o.belongsTo(c.Role) || !o.applies(v) {
+			continue
 		}
+		processed, err := o.process(v[o.key])
+		if err != nil {
+			return &FieldError{spec.protocol + "." + o.key, err}
+		}
+		v[o.key] = processed
 	}
-	return nil
+	return fromValues(v, section, spec.protocol)
 }
 
-func processSpec(spec specification) (string, error) {
-	config := make(Configuration)
-	config["protocol"] = spec.protocol
-	config["authToken"] = generateAuthToken()
-	for _, q := range spec.options {
-		config[q.key] = answer(q.prompt, q.process)
+// ClientConfig returns a copy of a server configuration with only the options that clients need.
+func (c *Configuration) ClientConfig() (*Configuration, error) {
+	spec, err := specFor(c.Protocol)
+	if err != nil {
+		return nil, &FieldError{"protocol", err}
+	}
+	v, err := toValues(c.section())
+	if err != nil {
+		return nil, err
+	}
+	kept := make(values)
+	for _, o := range spec.options {
+		if o.belongsTo("client") && v[o.key] != "" {
+			kept[o.key] = v[o.key]
+		}
+	}
+
+	conf := &Configuration{
+		Role:      "client",
+		Protocol:  c.Protocol,
+		AuthToken: c.AuthToken,
 	}
-	return writeConfig(config)
+	if err := fromValues(kept, conf.section(), c.Protocol); err != nil {
+		return nil, err
+	}
+	return conf, nil
 }
 
-func answer(prompt string, verify func(string) (string, error)) (data string) {
-	var err error
-	for {
-		data, err = verify(input(prompt))
-		if err == nil {
-			break
+// section returns a pointer to the options of the chosen protocol, allocating them if necessary.
+func (c *Configuration) section() interface{} {
+	switch c.Protocol {
+	case "https":
+		if c.HTTPS == nil {
+			c.HTTPS = &HTTPSConfig{}
 		}
-		color.HiRed("error: %s", err)
+		return c.HTTPS
+	case "tcp":
+		if c.TCP == nil {
+			c.TCP = &TCPConfig{}
+		}
+		return c.TCP
+	default:
+		return nil
 	}
-	return
 }
 
-func input(prompt string) string {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Printf("\n%s", prompt)
-	text, err := reader.ReadString('\n')
-	if err != nil {
-		panic(err)
+func specFor(protocol string) (specification, error) {
+	switch protocol {
+	case "https":
+		return https, nil
+	case "tcp":
+		return tcp, nil
+	case "":
+		return specification{}, errors.New("must be specified")
+	default:
+		return specification{}, errors.New("unknown protocol " + protocol)
 	}
-	return strings.TrimSpace(text)
 }
 
 func strList(list []string) string {
@@ -0,0 +1,546 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestLoadLegacyConfig(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "legacy.json")
+	legacy := `{
+	"protocol": "https",
+	"authToken": "` + generateAuthToken() + `",
+	"proxyAddr": "https://example.com",
+	"hostname": "example.com",
+	"email": "admin@example.com",
+	"pinRootCA": "yes",
+	"tlsMaxVersion": "1.3"
+}`
+	is.NoErr(ioutil.WriteFile(path, []byte(legacy), 0600))
+
+	conf, err := LoadConfig(path)
+	is.NoErr(err)
+	is.Equal(conf.HTTPS.ProxyAddr, "https://example.com")
+	is.True(conf.HTTPS.PinRootCA)
+	is.Equal(conf.HTTPS.CertSource, "acme") // defaults filled in
+	is.Equal(conf.HTTPS.ListenAddr, ":443")
+
+	backup, err := ioutil.ReadFile(path + ".bak")
+	is.NoErr(err)
+	is.Equal(string(backup), legacy)
+
+	migrated, err := LoadConfig(path) // rewritten in the new format
+	is.NoErr(err)
+	is.Equal(conf, migrated)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	is := is.New(t)
+
+	dir := t.TempDir()
+	load := func(data string) error {
+		path := filepath.Join(dir, "config.json")
+		is.NoErr(ioutil.WriteFile(path, []byte(data), 0600))
+		_, err := LoadConfig(path)
+		return err
+	}
+
+	token := generateAuthToken()
+
+	err := load(`{"protocol": "tcp", "authToken": "` + token + `", "tcp": {"serverAddr": "example.com", "serverPort": 8080, "serverPrt": 1}}`)
+	is.True(err != nil) // unknown field
+
+	err = load(`{"protocol": "tcp", "authToken": "` + token + `", "tcp": {"serverAddr": "example.com", "serverPort": 70000}}`)
+	var fieldErr *FieldError
+	is.True(errors.As(err, &fieldErr))
+	is.Equal(fieldErr.Field, "tcp.serverPort")
+
+	err = load(`{"protocol": "tcp", "authToken": "` + token + `", "serverAddr": "example.com", "serverPort": "8080", "typo": "x"}`)
+	is.True(errors.As(err, &fieldErr))
+	is.Equal(fieldErr.Field, "tcp.typo") // unknown key in legacy file
+
+	err = load(`{"protocol": "tcp", "authToken": "` + token + `", "tcp": {"serverAddr": "example.com", "serverPort": 8080, "tunnels": 17}}`)
+	is.True(errors.As(err, &fieldErr))
+	is.Equal(fieldErr.Field, "tcp.tunnels")
+
+	err = load(`{"protocol": "tcp", "authToken": "` + token + `", "tcp": {"serverAddr": "example.com", "serverPort": 8080}}`)
+	is.NoErr(err)
+}
+
+func TestEnvName(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(envName("proxyAddr"), "ROSEN_PROXY_ADDR")
+	is.Equal(envName("plainHTTP"), "ROSEN_PLAIN_HTTP")
+	is.Equal(envName("pinRootCA"), "ROSEN_PIN_ROOT_CA")
+	is.Equal(envName("caFingerprint"), "ROSEN_CA_FINGERPRINT")
+	is.Equal(envName("tlsMaxVersion"), "ROSEN_TLS_MAX_VERSION")
+}
+
+func TestClientConfigURI(t *testing.T) {
+	is := is.New(t)
+
+	server := &Configuration{
+		Role:      "server",
+		Protocol:  "https",
+		AuthToken: generateAuthToken(),
+		HTTPS: &HTTPSConfig{
+			ProxyAddr:     "https://example.com:8443",
+			Hostname:      "example.com",
+			Email:         "admin@example.com",
+			PinRootCA:     true,
+			TLSMaxVersion: "1.3",
+		},
+	}
+	is.NoErr(server.Verify())
+
+	client, err := server.ClientConfig()
+	is.NoErr(err)
+	is.NoErr(client.Verify())
+	is.Equal(client.Role, "client")
+	is.Equal(client.HTTPS.Email, "") // server only
+	is.Equal(client.HTTPS.ProxyAddr, server.HTTPS.ProxyAddr)
+
+	uri, err := server.URI()
+	is.NoErr(err)
+	imported, err := ParseURI(uri)
+	is.NoErr(err)
+	is.Equal(imported, client)
+}
+
+func TestEncryptedConfig(t *testing.T) {
+	is := is.New(t)
+
+	conf := &Configuration{
+		Role:      "client",
+		Protocol:  "tcp",
+		AuthToken: generateAuthToken(),
+		TCP: &TCPConfig{
+			ServerAddr: "example.com",
+			ServerPort: 8080,
+		},
+		passphrase: []byte("correct horse battery staple"),
+	}
+	path, err := writeConfig(conf, filepath.Join(t.TempDir(), "config.json"), false)
+	is.NoErr(err)
+
+	info, err := os.Stat(path)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(0600))
+
+	data, err := ioutil.ReadFile(path)
+	is.NoErr(err)
+	is.True(isEncrypted(data))
+	is.True(!bytes.Contains(data, []byte(conf.AuthToken)))
+
+	t.Setenv(PassphraseEnv, "wrong")
+	_, err = LoadConfig(path)
+	is.True(err != nil) // wrong passphrase
+
+	t.Setenv(PassphraseEnv, string(conf.passphrase))
+	loaded, err := LoadConfig(path)
+	is.NoErr(err)
+	is.Equal(loaded, conf)
+
+	// The key derivation parameters come from the file, so they are checked before use.
+	for field, params := range map[string]string{
+		"threads": `{"time": 3, "memory": 65536, "threads": 0}`,
+		"memory":  `{"time": 3, "memory": 4294967295, "threads": 4}`,
+		"time":    `{"time": 0, "memory": 65536, "threads": 4}`,
+	} {
+		var envelope map[string]map[string]json.RawMessage
+		is.NoErr(json.Unmarshal(data, &envelope))
+		envelope["encrypted"]["params"] = json.RawMessage(params)
+		tampered, err := json.Marshal(envelope)
+		is.NoErr(err)
+		is.NoErr(ioutil.WriteFile(path, tampered, 0600))
+		_, err = LoadConfig(path)
+		var fieldErr *FieldError
+		is.True(errors.As(err, &fieldErr))
+		is.Equal(fieldErr.Field, "encrypted.params."+field)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	is := is.New(t)
+
+	conf := &Configuration{
+		Role:      "server",
+		Protocol:  "tcp",
+		AuthToken: generateAuthToken(),
+		TCP:       &TCPConfig{ServerAddr: "example.com", ServerPort: 8080},
+	}
+	alice, err := conf.AddUser("alice")
+	is.NoErr(err)
+	_, err = conf.AddUser("alice")
+	is.True(err != nil) // duplicate
+	_, err = conf.AddUser(DefaultUser)
+	is.True(err != nil) // reserved
+	is.NoErr(conf.Verify())
+
+	client, err := conf.UserClientConfig("alice")
+	is.NoErr(err)
+	is.Equal(client.AuthToken, alice.Key)
+	is.Equal(len(client.Users), 0)
+	is.NoErr(client.Verify())
+
+	is.NoErr(conf.RemoveUser(DefaultUser))
+	is.Equal(conf.AuthToken, "")
+	is.NoErr(conf.Verify()) // alice is enough
+	_, err = conf.URI()
+	is.True(err != nil)                      // no authToken to share
+	is.True(conf.RemoveUser("alice") != nil) // last user
+
+	keys, err := conf.UserKeys()
+	is.NoErr(err)
+	is.Equal(len(keys), 1)
+	is.Equal(keys[0].Name, "alice")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.json")
+	is.NoErr(ioutil.WriteFile(path, []byte("{}"), 0644))
+	is.NoErr(SaveConfig(conf, path))
+	info, err := os.Stat(path)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(0600)) // replaced rather than rewritten in place
+	entries, err := ioutil.ReadDir(dir)
+	is.NoErr(err)
+	is.Equal(len(entries), 1) // no temporary file is left behind
+	_, err = writeConfig(conf, path, false)
+	is.True(err != nil) // not replaced without force
+
+	rotated := *conf
+	rotated.Users = []User{{Name: "alice", Key: generateAuthToken()}}
+	rotatedKeys, err := rotated.UserKeys()
+	is.NoErr(err)
+	is.Equal(RevokedUsers(keys, keys), []string(nil))
+	is.Equal(RevokedUsers(keys, rotatedKeys), []string{"alice"}) // same name, new key
+	is.Equal(RevokedUsers(keys, nil), []string{"alice"})
+
+	conf.Users = append(conf.Users, conf.Users[0])
+	var fieldErr *FieldError
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "users[1].name")
+}
+
+func TestRestartRequired(t *testing.T) {
+	is := is.New(t)
+
+	started := &Configuration{
+		Role:      "server",
+		Protocol:  "https",
+		AuthToken: generateAuthToken(),
+		HTTPS: &HTTPSConfig{
+			ProxyAddr:     "https://example.com",
+			Hostname:      "example.com",
+			Email:         "admin@example.com",
+			TLSMaxVersion: "1.3",
+		},
+	}
+	is.NoErr(started.Verify())
+
+	reloaded := *started
+	https := *started.HTTPS
+	reloaded.HTTPS = &https
+	_, err := reloaded.AddUser("alice")
+	is.NoErr(err)
+	reloaded.HTTPS.Decoy = "dir"
+	reloaded.HTTPS.DecoyDir = "/var/www"
+	reloaded.HTTPS.ListenAddr = ":8443"
+	is.NoErr(reloaded.Verify())
+
+	is.Equal(Changes(started, &reloaded), []string{"users", "https.listenAddr", "https.decoy", "https.decoyDir"})
+	is.Equal(RestartRequired(started, &reloaded, []string{"users", "https.decoy", "https.decoyDir"}), []string{"https.listenAddr"})
+}
+
+func TestLimits(t *testing.T) {
+	is := is.New(t)
+
+	for rate, expected := range map[string]int64{
+		"":         0,
+		"100B":     100,
+		"500KB/s":  500_000,
+		"10MiB/s":  10 << 20,
+		"1.5GB/s":  1_500_000_000,
+		"2 KiB/s":  2048,
+		"10Mbit/s": -1,
+		"fast":     -1,
+		"0B/s":     -1,
+		"-5MB/s":   -1,
+	} {
+		n, err := ParseRate(rate)
+		if expected == -1 {
+			is.True(err != nil) // invalid rate
+			continue
+		}
+		is.NoErr(err)
+		is.Equal(n, expected)
+	}
+
+	conf := &Configuration{
+		Role:      "server",
+		Protocol:  "tcp",
+		AuthToken: generateAuthToken(),
+		TCP:       &TCPConfig{ServerAddr: "example.com", ServerPort: 8080},
+		Limits:    &Limits{Total: "10MB/s", User: "2MB/s"},
+	}
+	_, err := conf.AddUser("alice")
+	is.NoErr(err)
+	conf.Users[0].Limit = "5MB/s"
+	is.NoErr(conf.Verify())
+
+	is.Equal(conf.TotalRate(), int64(10_000_000))
+	is.Equal(conf.StreamRate(), int64(0)) // unlimited
+	is.Equal(conf.UserRate("alice"), int64(5_000_000))
+	is.Equal(conf.UserRate(DefaultUser), int64(2_000_000))
+
+	client, err := conf.UserClientConfig("alice")
+	is.NoErr(err)
+	is.Equal(client.Limits, nil) // limits are enforced by the server
+
+	conf.Limits.Stream = "fast"
+	var fieldErr *FieldError
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "limits.stream")
+
+	client.Limits = &Limits{Total: "1MB/s"}
+	is.True(errors.As(client.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "limits")
+}
+
+func TestQuotas(t *testing.T) {
+	is := is.New(t)
+
+	conf := &Configuration{
+		Role:      "server",
+		Protocol:  "tcp",
+		AuthToken: generateAuthToken(),
+		TCP:       &TCPConfig{ServerAddr: "example.com", ServerPort: 8080},
+		Limits:    &Limits{DailyQuota: "1GB", MonthlyQuota: "1.5TiB"},
+	}
+	var fieldErr *FieldError
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "limits.dailyQuota") // needs a usage file
+
+	conf.UsageFile = "usage.json"
+	is.NoErr(conf.Verify())
+	is.Equal(conf.DailyQuota(), uint64(1e9))
+	is.Equal(conf.MonthlyQuota(), uint64(1.5*(1<<40)))
+
+	conf.Limits.MonthlyQuota = "10GB/s"
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "limits.monthlyQuota") // a size, not a rate
+}
+
+func TestStreamLimits(t *testing.T) {
+	is := is.New(t)
+
+	conf := &Configuration{
+		Role:      "server",
+		Protocol:  "tcp",
+		AuthToken: generateAuthToken(),
+		TCP:       &TCPConfig{ServerAddr: "example.com", ServerPort: 8080},
+		Limits:    &Limits{Streams: 100, IdleTimeout: "10m"},
+	}
+	is.NoErr(conf.Verify())
+	is.Equal(conf.MaxStreams(), 100)
+	idle, lifetime := conf.StreamTimeouts()
+	is.Equal(idle, 10*time.Minute)
+	is.Equal(lifetime, time.Duration(0)) // not set
+
+	var fieldErr *FieldError
+	conf.Limits.MaxLifetime = "1 day"
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "limits.maxLifetime")
+
+	conf.Limits.MaxLifetime = ""
+	conf.Limits.Streams = -1
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "limits.streams")
+}
+
+func TestPriorities(t *testing.T) {
+	is := is.New(t)
+
+	conf := &Configuration{
+		Role:       "client",
+		Protocol:   "tcp",
+		AuthToken:  generateAuthToken(),
+		TCP:        &TCPConfig{ServerAddr: "example.com", ServerPort: 8080},
+		Priorities: map[string]int{"22": 8},
+	}
+	is.NoErr(conf.Verify())
+	is.Equal(conf.PortWeight(22), 8)
+	is.Equal(conf.PortWeight(443), 1) // not set
+
+	var fieldErr *FieldError
+	conf.Priorities["ssh"] = 8
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "priorities.ssh")
+
+	delete(conf.Priorities, "ssh")
+	conf.Priorities["3389"] = 0
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "priorities.3389")
+}
+
+func TestKeepalive(t *testing.T) {
+	is := is.New(t)
+
+	conf := &Configuration{
+		Role:      "client",
+		Protocol:  "tcp",
+		AuthToken: generateAuthToken(),
+		TCP:       &TCPConfig{ServerAddr: "example.com", ServerPort: 8080},
+	}
+	is.NoErr(conf.Verify())
+	interval, timeout := conf.KeepaliveTimes()
+	is.Equal(interval, defaultKeepaliveInterval)
+	is.Equal(timeout, defaultKeepaliveTimeout)
+
+	conf.Keepalive = &Keepalive{Interval: "0"}
+	is.NoErr(conf.Verify())
+	interval, _ = conf.KeepaliveTimes()
+	is.Equal(interval, time.Duration(0)) // off
+
+	var fieldErr *FieldError
+	conf.Keepalive = &Keepalive{Interval: "1m"}
+	is.True(errors.As(conf.Verify(), &fieldErr)) // the default timeout is shorter
+	is.Equal(fieldErr.Field, "keepalive.timeout")
+
+	conf.Keepalive.Timeout = "3m"
+	is.NoErr(conf.Verify())
+}
+
+func TestServers(t *testing.T) {
+	is := is.New(t)
+
+	conf := &Configuration{
+		Role:      "client",
+		Protocol:  "tcp",
+		AuthToken: generateAuthToken(),
+		TCP:       &TCPConfig{ServerAddr: "example.com", ServerPort: 8080},
+		Servers: []Server{
+			{Name: "backup", Priority: 1, Protocol: "https", AuthToken: generateAuthToken(), HTTPS: &HTTPSConfig{ProxyAddr: "https://backup.example.com"}},
+			{Protocol: "tcp", AuthToken: generateAuthToken(), TCP: &TCPConfig{ServerAddr: "192.0.2.1", ServerPort: 9000}},
+		},
+		Selection: "latency",
+	}
+	is.NoErr(conf.Verify())
+
+	endpoints := conf.Endpoints()
+	is.Equal(len(endpoints), 3)
+	is.Equal(endpoints[0].Addr, "example.com:8080")
+	is.Equal(endpoints[1].Name, "backup")
+	is.Equal(endpoints[1].Addr, "backup.example.com:443")
+	is.Equal(endpoints[1].Config.Protocol, "https")
+	is.Equal(endpoints[2].Addr, "192.0.2.1:9000")
+
+	var fieldErr *FieldError
+	conf.Servers[1].TCP.ServerPort = 70000
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "servers[1].tcp.serverPort")
+	conf.Servers[1].TCP.ServerPort = 9000
+
+	conf.Servers[0].AuthToken = ""
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "servers[0].authToken")
+	conf.Servers[0].AuthToken = generateAuthToken()
+
+	conf.Selection = "random"
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "selection")
+	conf.Selection = ""
+
+	conf.Role = "server"
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "servers")
+}
+
+func TestUpstream(t *testing.T) {
+	is := is.New(t)
+
+	conf := &Configuration{
+		Role:      "server",
+		Protocol:  "tcp",
+		AuthToken: generateAuthToken(),
+		TCP:       &TCPConfig{ServerAddr: "example.com", ServerPort: 8080},
+		Upstream: &Configuration{
+			Protocol:  "tcp",
+			AuthToken: generateAuthToken(),
+			TCP:       &TCPConfig{ServerAddr: "exit.example.com", ServerPort: 9000},
+		},
+	}
+	is.NoErr(conf.Verify())
+	is.Equal(conf.Upstream.Role, "client")
+
+	client, err := conf.ClientConfig()
+	is.NoErr(err)
+	is.Equal(client.Upstream, nil) // clients only need the first hop
+
+	var fieldErr *FieldError
+	conf.Upstream.TCP.ServerPort = 0
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "upstream.tcp.serverPort")
+	conf.Upstream.TCP.ServerPort = 9000
+
+	conf.Upstream.Role = "server"
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "upstream.role")
+	conf.Upstream.Role = "client"
+
+	conf.Role = "client"
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "upstream")
+}
+
+func TestDial(t *testing.T) {
+	is := is.New(t)
+
+	conf := &Configuration{
+		Role:      "server",
+		Protocol:  "tcp",
+		AuthToken: generateAuthToken(),
+		TCP:       &TCPConfig{ServerAddr: "example.com", ServerPort: 8080},
+		Dial:      &Dial{Timeout: "5s", Proxy: "socks5://127.0.0.1:1080", SourceAddr: "::1", Prefer: "ipv6"},
+	}
+	is.NoErr(conf.Verify())
+	is.Equal(conf.DialTimeout(), 5*time.Second)
+
+	var fieldErr *FieldError
+	for field, set := range map[string]func(d *Dial){
+		"dial.timeout":    func(d *Dial) { d.Timeout = "-1s" },
+		"dial.proxy":      func(d *Dial) { d.Proxy = "http://127.0.0.1:8080" },
+		"dial.sourceAddr": func(d *Dial) { d.SourceAddr = "localhost" },
+		"dial.prefer":     func(d *Dial) { d.Prefer = "ipv5" },
+	} {
+		d := *conf.Dial
+		set(conf.Dial)
+		is.True(errors.As(conf.Verify(), &fieldErr))
+		is.Equal(fieldErr.Field, field)
+		*conf.Dial = d
+	}
+
+	conf.Upstream = &Configuration{
+		Protocol:  "tcp",
+		AuthToken: generateAuthToken(),
+		TCP:       &TCPConfig{ServerAddr: "exit.example.com", ServerPort: 9000},
+	}
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "dial") // the next server opens the streams
+	conf.Upstream = nil
+
+	conf.Role = "client"
+	is.True(errors.As(conf.Verify(), &fieldErr))
+	is.Equal(fieldErr.Field, "dial")
+}
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/fatih/color"
+	"golang.org/x/term"
+)
+
+// ConfigureResult describes the configuration files written by Configure.
+type ConfigureResult struct {
+	ServerFile string
+	ClientFile string
+
+	// Client is the configuration written to ClientFile.
+	Client *Configuration
+}
+
+// ConfigureOptions holds values given to Configure up front, so that it can run without asking any questions.
+type ConfigureOptions struct {
+	// Output is the path the server configuration is written to. If empty, a random filename in the working directory is chosen.
+	// The client configuration is written next to it, with a -client suffix.
+	Output string
+
+	// Force allows existing files to be overwritten.
+	Force bool
+
+	// Encrypt protects the files with a passphrase, which is read from the environment or the terminal.
+	Encrypt bool
+
+	preset values
+}
+
+// RegisterFlags defines a flag on fs for every configuration option, along with -out and -force.
+// Options that are not given as flags are read from ROSEN_* environment variables, and otherwise asked for.
+func RegisterFlags(fs *flag.FlagSet) *ConfigureOptions {
+	opts := &ConfigureOptions{preset: make(values)}
+
+	fs.StringVar(&opts.Output, "out", "", "Path to write the server configuration to when used with -configure. The client configuration is written alongside it.")
+	fs.BoolVar(&opts.Force, "force", false, "Overwrite configuration files that already exist.")
+	fs.BoolVar(&opts.Encrypt, "encrypt", false, "Encrypt the configuration files with a passphrase (from "+PassphraseEnv+" or the terminal).")
+
+	register := func(key, prompt string) {
+		if fs.Lookup(key) != nil {
+			return // options shared by several protocols
+		}
+		usage := strings.SplitN(prompt, "\n", 2)[0]
+		if strings.HasPrefix(usage, "Enter ") {
+			usage = strings.ToUpper(usage[6:7]) + usage[7:]
+		}
+		fs.Func(key, fmt.Sprintf("%s (configure; env %s)", usage, envName(key)), func(value string) error {
+			opts.preset[key] = value
+			return nil
+		})
+	}
+	register("protocol", protocolPrompt)
+	for _, spec := range []specification{https, tcp} {
+		for _, o := range spec.options {
+			if o.prompt != "" {
+				register(o.key, o.prompt)
+			}
+		}
+	}
+
+	return opts
+}
+
+var protocolPrompt = fmt.Sprintf("Which protocol do you want to use?\nChoose from {%s}\n> ", strList(protocols))
+
+// Configure launches the quiz that asks the user for configuration values.
+// Values given in opts or in the environment are used without asking. If stdin is not a terminal, any required value
+// that was not given is an error. The resulting server and client configurations are written out.
+func Configure(opts *ConfigureOptions) (*ConfigureResult, error) {
+	if opts == nil {
+		opts = &ConfigureOptions{}
+	}
+
+	protocol, err := opts.value("protocol", protocolPrompt, func(resp string) (string, error) {
+		if !contains(protocols, resp) {
+			return "", errors.New("invalid protocol")
+		}
+		return resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := specFor(protocol)
+	if err != nil {
+		panic("error: unknown protocol") // should never happen
+	}
+	return processSpec(spec, opts)
+}
+
+func processSpec(spec specification, opts *ConfigureOptions) (*ConfigureResult, error) {
+	v := make(values)
+	for _, q := range spec.options {
+		if q.prompt == "" || !q.applies(v) {
+			continue
+		}
+		answer, err := opts.value(q.key, q.prompt, q.process)
+		if err != nil {
+			return nil, err
+		}
+		v[q.key] = answer
+	}
+	if spec.finalise != nil {
+		if err := spec.finalise(v); err != nil {
+			return nil, err
+		}
+	}
+
+	server := &Configuration{
+		Role:      "server",
+		Protocol:  spec.protocol,
+		AuthToken: generateAuthToken(),
+	}
+	if err := fromValues(v, server.section(), spec.protocol); err != nil {
+		return nil, err
+	}
+	if err := server.Verify(); err != nil {
+		return nil, err
+	}
+	client, err := server.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Encrypt {
+		passphrase, err := ReadPassphrase(true)
+		if err != nil {
+			return nil, err
+		}
+		server.passphrase = passphrase
+		client.passphrase = passphrase
+	}
+
+	result := &ConfigureResult{Client: client}
+	serverFile := opts.Output
+	if serverFile == "" {
+		serverFile = randConfigFileName()
+	}
+	if result.ServerFile, err = writeConfig(server, serverFile, opts.Force); err != nil {
+		return result, err
+	}
+	result.ClientFile, err = writeConfig(client, clientConfigPath(result.ServerFile), opts.Force)
+	return result, err
+}
+
+// value returns the value for an option from the flags, the environment or the user, in that order.
+func (opts *ConfigureOptions) value(key, prompt string, process func(string) (string, error)) (string, error) {
+	resp, ok := opts.preset[key]
+	if !ok {
+		resp, ok = os.LookupEnv(envName(key))
+	}
+	if ok {
+		v, err := process(resp)
+		if err != nil {
+			return "", &FieldError{key, err}
+		}
+		return v, nil
+	}
+
+	if !stdinIsTerminal() {
+		if v, err := process(""); err == nil {
+			return v, nil // option has a default
+		}
+		return "", &FieldError{key, fmt.Errorf("must be set with -%s or %s since stdin is not a terminal", key, envName(key))}
+	}
+
+	return answer(prompt, process)
+}
+
+// envName returns the environment variable for an option, for example ROSEN_PROXY_ADDR for proxyAddr.
+func envName(key string) string {
+	var b strings.Builder
+	b.WriteString("ROSEN_")
+	runes := []rune(key)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || (unicode.IsUpper(runes[i-1]) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func stdinIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+func answer(prompt string, verify func(string) (string, error)) (string, error) {
+	for {
+		resp, err := input(prompt)
+		if err != nil {
+			return "", err
+		}
+		data, err := verify(resp)
+		if err == nil {
+			return data, nil
+		}
+		color.HiRed("error: %s", err)
+	}
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+func input(prompt string) (string, error) {
+	fmt.Printf("\n%s", prompt)
+	text, err := stdin.ReadString('\n')
+	if err == io.EOF && text != "" {
+		err = nil // last line without a newline
+	}
+	if err == io.EOF {
+		return "", errors.New("unexpected end of input")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(text), nil
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/awnumar/rosen/crypto"
+
+	"golang.org/x/term"
+	"lukechampine.com/frand"
+)
+
+// PassphraseEnv is the environment variable that encrypted configuration files are unlocked with.
+// If it is not set, the passphrase is asked for on the terminal.
+const PassphraseEnv = "ROSEN_CONFIG_PASSPHRASE"
+
+// encryptedConfig is the on-disk format of a configuration file encrypted with a passphrase.
+type encryptedConfig struct {
+	Encrypted *encryptedPayload `json:"encrypted"`
+}
+
+// Bounds of the key derivation parameters that decrypt accepts, as they come from the file: the defaults are well
+// within them, and anything beyond would take too long or too much memory, or make argon2 panic.
+const (
+	maxKDFTime    = 16
+	maxKDFMemory  = 1 << 20 // KiB, so 1GiB
+	maxKDFThreads = 64
+)
+
+type encryptedPayload struct {
+	KDF        string           `json:"kdf"`
+	Params     crypto.KDFParams `json:"params"`
+	Salt       []byte           `json:"salt"`
+	Ciphertext []byte           `json:"ciphertext"`
+}
+
+// isEncrypted reports whether data holds an encrypted configuration.
+func isEncrypted(data []byte) bool {
+	var envelope encryptedConfig
+	return json.Unmarshal(data, &envelope) == nil && envelope.Encrypted != nil
+}
+
+func encrypt(plaintext, passphrase []byte) ([]byte, error) {
+	payload := &encryptedPayload{
+		KDF:    "argon2id",
+		Params: crypto.DefaultKDFParams,
+		Salt:   frand.Bytes(16),
+	}
+	cipher, err := crypto.NewCipher(crypto.PassphraseKey(passphrase, payload.Salt, payload.Params))
+	if err != nil {
+		return nil, err
+	}
+	if payload.Ciphertext, err = cipher.Encrypt(plaintext); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(&encryptedConfig{payload}, "", "	")
+}
+
+func decrypt(data, passphrase []byte) ([]byte, error) {
+	var envelope encryptedConfig
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	payload := envelope.Encrypted
+	if payload.KDF != "argon2id" {
+		return nil, errors.New("config error: unsupported kdf " + payload.KDF)
+	}
+	if err := verifyKDFParams(payload.Params); err != nil {
+		return nil, err
+	}
+	cipher, err := crypto.NewCipher(crypto.PassphraseKey(passphrase, payload.Salt, payload.Params))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := cipher.Decrypt(payload.Ciphertext)
+	if err != nil {
+		return nil, errors.New("config error: failed to decrypt config (is the passphrase correct?)")
+	}
+	return plaintext, nil
+}
+
+func verifyKDFParams(params crypto.KDFParams) error {
+	switch {
+	case params.Time < 1 || params.Time > maxKDFTime:
+		return &FieldError{"encrypted.params.time", fmt.Errorf("must be between 1 and %d", maxKDFTime)}
+	case params.Threads < 1 || params.Threads > maxKDFThreads:
+		return &FieldError{"encrypted.params.threads", fmt.Errorf("must be between 1 and %d", maxKDFThreads)}
+	case params.Memory < 8*uint32(params.Threads) || params.Memory > maxKDFMemory:
+		return &FieldError{"encrypted.params.memory", fmt.Errorf("must be between 8KiB per thread and %dKiB", maxKDFMemory)}
+	}
+	return nil
+}
+
+// ReadPassphrase returns the passphrase from the environment, or asks for it on the terminal.
+// If confirm is set, the user has to enter it twice.
+func ReadPassphrase(confirm bool) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(PassphraseEnv); ok {
+		return []byte(passphrase), nil
+	}
+	if !stdinIsTerminal() {
+		return nil, errors.New("config is encrypted; set " + PassphraseEnv + " since stdin is not a terminal")
+	}
+
+	fmt.Print("\nConfig passphrase: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase must not be empty")
+	}
+	if confirm {
+		fmt.Print("Confirm passphrase: ")
+		again, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil {
+			return nil, err
+		}
+		if string(again) != string(passphrase) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
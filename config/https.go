@@ -1,10 +1,16 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"net"
 	"strings"
 
 	"github.com/asaskevich/govalidator"
+
+	"github.com/awnumar/rosen/crypto"
 )
 
 var https = specification{
@@ -35,6 +41,78 @@ var https = specification{
 				}
 				return resp, nil
 			},
+			serverOnly: true,
+		},
+		{
+			key:        "plainHTTP",
+			prompt:     "Will the server run behind a reverse proxy that terminates TLS, and so serve plain HTTP? (yes/no)\nLeave empty for no.\n> ",
+			process:    processYesNo("no"),
+			serverOnly: true,
+		},
+		{
+			key:        "listenAddr",
+			prompt:     "Enter the address that the server will listen on.\nLeave empty for the default (:443).\n> ",
+			process:    processListenAddr(":443", false),
+			serverOnly: true,
+		},
+		{
+			key:        "redirectAddr",
+			prompt:     "Enter the address for the plain HTTP listener that redirects visitors to HTTPS, or none to disable it.\nLeave empty for the default (:80).\n> ",
+			process:    processListenAddr(":80", true),
+			condition:  func(c values) bool { return c["plainHTTP"] != "yes" },
+			serverOnly: true,
+		},
+		{
+			key:        "proxyProtocol",
+			prompt:     "Will connections be received with a PROXY protocol (v1 or v2) header from a load balancer? (yes/no)\nLeave empty for no.\n> ",
+			process:    processYesNo("no"),
+			serverOnly: true,
+		},
+		{
+			key:    "certSource",
+			prompt: fmt.Sprintf("Where should the server get its TLS certificate from?\nChoose from {%s}\n> ", strList(certSources)),
+			process: func(resp string) (string, error) {
+				resp = strings.TrimSpace(resp)
+				if resp == "" {
+					return "acme", nil // default for configs created before this option existed
+				}
+				if !contains(certSources, resp) {
+					return "", errors.New("must be one of " + strList(certSources))
+				}
+				return resp, nil
+			},
+		},
+		{
+			key:        "certFile",
+			prompt:     "Enter the path to the PEM encoded certificate (chain) on the server.\nIt will be reloaded automatically when it changes.\n> ",
+			process:    processPath,
+			condition:  servesTLSFrom("files"),
+			serverOnly: true,
+		},
+		{
+			key:        "keyFile",
+			prompt:     "Enter the path to the PEM encoded private key on the server.\n> ",
+			process:    processPath,
+			condition:  servesTLSFrom("files"),
+			serverOnly: true,
+		},
+		{
+			key:        "caDir",
+			prompt:     "Enter the directory in which the server will keep its self-signed CA.\nA new CA will be created there if one does not exist.\n> ",
+			process:    processPath,
+			condition:  certSourceIs("selfsigned"),
+			serverOnly: true,
+		},
+		{
+			key:       "caFingerprint",
+			prompt:    "Enter the SHA-256 fingerprint of the CA that issued the certificate, for the client to pin.\nLeave empty to verify against the system roots instead.\n> ",
+			process:   processOptional(processFingerprint),
+			condition: certSourceIs("files"),
+		},
+		{
+			key:       "caFingerprint", // filled in when the CA is created
+			process:   processFingerprint,
+			condition: certSourceIs("selfsigned"),
 		},
 		{
 			key:    "email",
@@ -47,6 +125,8 @@ var https = specification{
 				}
 				return resp, nil
 			},
+			condition:  servesTLSFrom("acme"),
+			serverOnly: true,
 		},
 		{
 			key:    "pinRootCA",
@@ -59,6 +139,42 @@ var https = specification{
 				}
 				return resp, nil
 			},
+			condition: certSourceIs("acme"),
+		},
+		{
+			key:    "decoy",
+			prompt: fmt.Sprintf("What should the server show to visitors without a valid key?\nChoose from {%s}, or leave empty for static.\n> ", strList(decoys)),
+			process: func(resp string) (string, error) {
+				resp = strings.TrimSpace(resp)
+				if resp == "" {
+					return "static", nil
+				}
+				if !contains(decoys, resp) {
+					return "", errors.New("must be one of " + strList(decoys))
+				}
+				return resp, nil
+			},
+			serverOnly: true,
+		},
+		{
+			key:    "decoyUpstream",
+			prompt: "Enter the URL of the website that visitors should be proxied to.\n> ",
+			process: func(resp string) (string, error) {
+				resp = strings.TrimSpace(resp)
+				if !govalidator.IsURL(resp) || !(strings.HasPrefix(resp, "https://") || strings.HasPrefix(resp, "http://")) {
+					return "", errors.New("must be an http:// or https:// URL")
+				}
+				return resp, nil
+			},
+			condition:  func(c values) bool { return c["decoy"] == "proxy" },
+			serverOnly: true,
+		},
+		{
+			key:        "decoyDir",
+			prompt:     "Enter the path to the directory on the server that visitors should be served from.\n> ",
+			process:    processPath,
+			condition:  func(c values) bool { return c["decoy"] == "dir" },
+			serverOnly: true,
 		},
 		{
 			key:    "tlsMaxVersion",
@@ -70,6 +186,125 @@ var https = specification{
 				}
 				return resp, nil
 			},
+			serverOnly: true,
+		},
+		{
+			key:    "authLocation",
+			prompt: fmt.Sprintf("Where in each request should the client carry its authentication token?\nChoose from {%s}, or leave empty for cookie.\n> ", strList(authLocations)),
+			process: func(resp string) (string, error) {
+				resp = strings.TrimSpace(resp)
+				if resp == "" {
+					return "cookie", nil
+				}
+				if !contains(authLocations, resp) {
+					return "", errors.New("must be one of " + strList(authLocations))
+				}
+				return resp, nil
+			},
+		},
+		{
+			key:    "authName",
+			prompt: "Enter the name of the cookie, query parameter or header that holds the token.\nLeave empty for the default (session, token or Authorization respectively).\n> ",
+			process: func(resp string) (string, error) {
+				resp = strings.TrimSpace(resp)
+				for _, r := range resp {
+					if r <= ' ' || r >= 0x7F || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r) {
+						return "", errors.New("must only contain letters, digits and symbols such as - and _")
+					}
+				}
+				return resp, nil
+			},
 		},
 	},
+	finalise: func(c values) error {
+		if c["certSource"] != "selfsigned" {
+			return nil
+		}
+		ca, err := crypto.LoadOrCreateCA(c["caDir"])
+		if err != nil {
+			return err
+		}
+		c["caFingerprint"] = ca.Fingerprint()
+		return nil
+	},
+}
+
+var (
+	certSources   = []string{"acme", "files", "selfsigned"}
+	decoys        = []string{"static", "proxy", "dir"}
+	authLocations = []string{"cookie", "query", "header"}
+)
+
+func certSourceIs(source string) func(values) bool {
+	return func(c values) bool {
+		return c["certSource"] == source
+	}
+}
+
+// servesTLSFrom is like certSourceIs but additionally requires that the server terminates TLS itself.
+func servesTLSFrom(source string) func(values) bool {
+	return func(c values) bool {
+		return c["plainHTTP"] != "yes" && c["certSource"] == source
+	}
+}
+
+func processFingerprint(resp string) (string, error) {
+	resp = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(resp), ":", ""))
+	if b, err := hex.DecodeString(resp); err != nil || len(b) != sha256.Size {
+		return "", errors.New("must be a hex encoded SHA-256 fingerprint")
+	}
+	return resp, nil
+}
+
+func processOptional(process func(string) (string, error)) func(string) (string, error) {
+	return func(resp string) (string, error) {
+		if strings.TrimSpace(resp) == "" {
+			return "", nil
+		}
+		return process(resp)
+	}
+}
+
+func processYesNo(def string) func(string) (string, error) {
+	return func(resp string) (string, error) {
+		resp = strings.TrimSpace(resp)
+		if resp == "" {
+			return def, nil
+		}
+		if resp != "yes" && resp != "no" {
+			return "", errors.New("must be yes or no")
+		}
+		return resp, nil
+	}
+}
+
+func processListenAddr(def string, allowNone bool) func(string) (string, error) {
+	return func(resp string) (string, error) {
+		resp = strings.TrimSpace(resp)
+		if resp == "" {
+			return def, nil
+		}
+		if allowNone && resp == "none" {
+			return resp, nil
+		}
+		host, port, err := net.SplitHostPort(resp)
+		if err != nil {
+			return "", errors.New("must be of the form host:port, where host may be empty")
+		}
+		if host != "" && !(govalidator.IsDNSName(host) || govalidator.IsIP(host)) {
+			return "", errors.New("must have a valid hostname or IP address")
+		}
+		if !govalidator.IsPort(port) {
+			return "", errors.New("must have a valid port number in the range 1-65535")
+		}
+		return resp, nil
+	}
+}
+
+func processPath(resp string) (string, error) {
+	resp = strings.TrimSpace(resp)
+	if resp == "" {
+		return "", errors.New("must be a path")
+	}
+	return resp, nil
 }
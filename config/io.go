@@ -1,40 +1,183 @@
 package config
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 
 	"lukechampine.com/frand"
 )
 
 // LoadConfig loads a configuration from a file.
-func LoadConfig(filepath string) (Configuration, error) {
-	data, err := ioutil.ReadFile(filepath)
+// Encrypted files are unlocked with a passphrase from the environment or the terminal.
+// Files in the older format, a flat map of strings, are converted and rewritten in place. The original is kept with a .bak suffix.
+func LoadConfig(path string) (*Configuration, error) {
+	return loadConfig(path, nil)
+}
+
+// ReloadConfig loads the configuration at path again, unlocking it with the passphrase of the current configuration
+// so that it is not asked for every time.
+func ReloadConfig(current *Configuration, path string) (*Configuration, error) {
+	return loadConfig(path, current.passphrase)
+}
+
+func loadConfig(path string, passphrase []byte) (*Configuration, error) {
+	info, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
-	var conf Configuration
-	if err := json.Unmarshal(data, &conf); err != nil {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
 		return nil, err
 	}
-	return conf, verify(conf)
+
+	if !isEncrypted(data) {
+		passphrase = nil // the file is no longer encrypted
+		if runtime.GOOS != "windows" && info.Mode().Perm()&0o004 != 0 {
+			slog.Warn("config file contains a secret key but is readable by every user; fix with chmod 600", "path", path)
+		}
+	} else {
+		if passphrase == nil {
+			if passphrase, err = ReadPassphrase(false); err != nil {
+				return nil, err
+			}
+		}
+		if data, err = decrypt(data, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	if passphrase == nil && isLegacy(data) { // encrypted files are never in the older format
+		conf, err := migrate(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := rewriteMigrated(path, data, conf); err != nil {
+			slog.Warn("failed to save migrated config", "path", path, "err", err)
+		}
+		return conf, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	conf := &Configuration{passphrase: passphrase}
+	if err := decoder.Decode(conf); err != nil {
+		return nil, fmt.Errorf("config error: %w", err)
+	}
+	return conf, conf.Verify()
 }
 
-func writeConfig(config Configuration) (string, error) {
+// isLegacy reports whether data holds a configuration from before options were grouped by protocol.
+func isLegacy(data []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+	_, https := fields["https"]
+	_, tcp := fields["tcp"]
+	return !https && !tcp && len(fields) > 2
+}
+
+func migrate(data []byte) (*Configuration, error) {
+	var legacy map[string]string
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, fmt.Errorf("config error: %w", err)
+	}
+
+	conf := &Configuration{
+		Protocol:  legacy["protocol"],
+		AuthToken: legacy["authToken"],
+	}
+	delete(legacy, "protocol")
+	delete(legacy, "authToken")
+
+	if _, err := specFor(conf.Protocol); err != nil {
+		return nil, &FieldError{"protocol", err}
+	}
+	if err := fromValues(values(legacy), conf.section(), conf.Protocol); err != nil {
+		return nil, err
+	}
+	return conf, conf.Verify()
+}
+
+func rewriteMigrated(path string, original []byte, conf *Configuration) error {
+	data, err := conf.JSON()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".bak", original, 0600); err != nil {
+		return err
+	}
+	return replaceFile(path, data)
+}
+
+// SaveConfig replaces the file at path with the configuration, for example after its users have changed.
+// Configurations that were loaded from an encrypted file are encrypted again with the same passphrase.
+func SaveConfig(conf *Configuration, path string) error {
+	if err := conf.Verify(); err != nil {
+		return err
+	}
+	_, err := writeConfig(conf, path, true)
+	return err
+}
+
+// writeConfig writes the configuration to path and returns its absolute path.
+// The file is only readable by its owner, and is encrypted if the configuration has a passphrase.
+// An existing file is only replaced if force is set.
+func writeConfig(config *Configuration, path string, force bool) (string, error) {
 	data, err := config.JSON()
 	if err != nil {
 		return "", err
 	}
-	filename, err := filepath.Abs(randConfigFileName())
+	if config.passphrase != nil {
+		if data, err = encrypt(data, config.passphrase); err != nil {
+			return "", err
+		}
+	}
+	filename, err := filepath.Abs(path)
 	if err != nil {
 		return "", err
 	}
-	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
-		return filename, err
+
+	if !force {
+		if _, err := os.Lstat(filename); err == nil {
+			return "", errors.New(filename + " already exists; use -force to overwrite it")
+		}
+	}
+	return filename, replaceFile(filename, data)
+}
+
+// replaceFile writes data to a file that only its owner can read, and renames it to path, so that a server watching
+// path never reads it half written.
+func replaceFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*") // created with mode 0600
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
 	}
-	return filename, nil
+	return os.Rename(tmp.Name(), path)
+}
+
+// clientConfigPath returns the path of the client configuration that goes with a server configuration,
+// for example example-client.json for example.json.
+func clientConfigPath(serverPath string) string {
+	ext := filepath.Ext(serverPath)
+	return strings.TrimSuffix(serverPath, ext) + "-client" + ext
 }
 
 func randConfigFileName() string {
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	defaultKeepaliveInterval = 15 * time.Second
+	defaultKeepaliveTimeout  = 45 * time.Second
+)
+
+// Keepalive sets how tcp tunnels check that the remote end is still there. Durations are written like 15s or 1m.
+type Keepalive struct {
+	// Interval is how often the remote end is pinged. The default is 15s, and 0 turns keepalives off.
+	Interval string `json:"interval,omitempty"`
+
+	// Timeout is how long the remote end can go unheard before the tunnel is closed. The default is 45s.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// KeepaliveTimes returns how often tunnels ping the remote end, or 0 if they do not, and how long the remote end can
+// go unheard before the tunnel is closed.
+func (c *Configuration) KeepaliveTimes() (interval, timeout time.Duration) {
+	interval, timeout = defaultKeepaliveInterval, defaultKeepaliveTimeout
+	if c.Keepalive == nil {
+		return interval, timeout
+	}
+	if c.Keepalive.Interval != "" {
+		interval, _ = time.ParseDuration(c.Keepalive.Interval)
+	}
+	if c.Keepalive.Timeout != "" {
+		timeout, _ = time.ParseDuration(c.Keepalive.Timeout)
+	}
+	return interval, timeout
+}
+
+func (c *Configuration) verifyKeepalive() error {
+	if c.Keepalive == nil {
+		return nil
+	}
+	if c.Keepalive.Interval != "" {
+		if d, err := time.ParseDuration(c.Keepalive.Interval); err != nil || d < 0 {
+			return &FieldError{"keepalive.interval", errors.New("must be a duration, such as 15s, or 0 to turn keepalives off")}
+		}
+	}
+	if c.Keepalive.Timeout != "" {
+		if d, err := time.ParseDuration(c.Keepalive.Timeout); err != nil || d <= 0 {
+			return &FieldError{"keepalive.timeout", errors.New("must be a duration, such as 45s")}
+		}
+	}
+	if interval, timeout := c.KeepaliveTimes(); interval > 0 && timeout <= interval {
+		return &FieldError{"keepalive.timeout", errors.New("must be longer than the interval")}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits caps the throughput of a server. Rates are written like 10MB/s or 512KiB/s and apply to each direction
+// separately. Rates that are not set are unlimited.
+type Limits struct {
+	// Total is shared by every user of the server.
+	Total string `json:"total,omitempty"`
+
+	// User applies to each user, unless the user has a limit of their own.
+	User string `json:"user,omitempty"`
+
+	// Stream applies to each stream.
+	Stream string `json:"stream,omitempty"`
+
+	// Streams is the number of streams that each user can have open at once.
+	Streams int `json:"streams,omitempty"`
+
+	// IdleTimeout closes streams that have not passed any data for this long, such as 10m.
+	IdleTimeout string `json:"idleTimeout,omitempty"`
+
+	// MaxLifetime closes streams that have been open for this long, such as 24h.
+	MaxLifetime string `json:"maxLifetime,omitempty"`
+
+	// DailyQuota and MonthlyQuota cap the traffic of each user in both directions together, such as 10GB.
+	// Once a quota has been used up, new streams of the user are refused. They need a usage file to be set.
+	DailyQuota   string `json:"dailyQuota,omitempty"`
+	MonthlyQuota string `json:"monthlyQuota,omitempty"`
+}
+
+var (
+	ratePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGT]i?)?B(?:/s)?$`)
+	sizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGT]i?)?B$`)
+)
+
+var rateUnits = map[string]float64{
+	"":   1,
+	"K":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// ParseRate returns the number of bytes per second in a rate such as 10MB/s, or 0 for an empty string.
+func ParseRate(s string) (int64, error) {
+	return parseBytes(s, ratePattern, "must be a rate in bytes per second, such as 500KB/s or 10MiB/s")
+}
+
+// ParseSize returns the number of bytes in a size such as 10GB, or 0 for an empty string.
+func ParseSize(s string) (int64, error) {
+	return parseBytes(s, sizePattern, "must be a number of bytes, such as 500MB or 10GiB")
+}
+
+func parseBytes(s string, pattern *regexp.Regexp, help string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m := pattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, errors.New(help)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	bytes := int64(n * rateUnits[m[2]])
+	if bytes <= 0 {
+		return 0, errors.New("must be more than 0 bytes")
+	}
+	return bytes, nil
+}
+
+// TotalRate returns the rate shared by every user in bytes per second, or 0 if it is unlimited.
+func (c *Configuration) TotalRate() int64 {
+	if c.Limits == nil {
+		return 0
+	}
+	rate, _ := ParseRate(c.Limits.Total)
+	return rate
+}
+
+// StreamRate returns the rate of each stream in bytes per second, or 0 if it is unlimited.
+func (c *Configuration) StreamRate() int64 {
+	if c.Limits == nil {
+		return 0
+	}
+	rate, _ := ParseRate(c.Limits.Stream)
+	return rate
+}
+
+// UserRate returns the rate of a user in bytes per second, or 0 if it is unlimited.
+func (c *Configuration) UserRate(name string) int64 {
+	if i := c.user(name); i != -1 && c.Users[i].Limit != "" {
+		rate, _ := ParseRate(c.Users[i].Limit)
+		return rate
+	}
+	if c.Limits == nil {
+		return 0
+	}
+	rate, _ := ParseRate(c.Limits.User)
+	return rate
+}
+
+// DailyQuota returns the number of bytes that each user may transfer per day, or 0 if it is unlimited.
+func (c *Configuration) DailyQuota() uint64 {
+	if c.Limits == nil {
+		return 0
+	}
+	quota, _ := ParseSize(c.Limits.DailyQuota)
+	return uint64(quota)
+}
+
+// MonthlyQuota returns the number of bytes that each user may transfer per month, or 0 if it is unlimited.
+func (c *Configuration) MonthlyQuota() uint64 {
+	if c.Limits == nil {
+		return 0
+	}
+	quota, _ := ParseSize(c.Limits.MonthlyQuota)
+	return uint64(quota)
+}
+
+// MaxStreams returns the number of streams that each user can have open at once, or 0 if it is unlimited.
+func (c *Configuration) MaxStreams() int {
+	if c.Limits == nil {
+		return 0
+	}
+	return c.Limits.Streams
+}
+
+// StreamTimeouts returns the idle timeout and the maximum lifetime of streams. Either is 0 if it is not set.
+func (c *Configuration) StreamTimeouts() (idle, lifetime time.Duration) {
+	if c.Limits == nil {
+		return 0, 0
+	}
+	idle, _ = time.ParseDuration(c.Limits.IdleTimeout)
+	lifetime, _ = time.ParseDuration(c.Limits.MaxLifetime)
+	return idle, lifetime
+}
+
+func (c *Configuration) verifyLimits() error {
+	if c.UsageFile != "" && c.Role == "client" {
+		return &FieldError{"usageFile", errors.New("must only be set in server configurations")}
+	}
+	if c.Limits != nil {
+		if c.Role == "client" {
+			return &FieldError{"limits", errors.New("must only be set in server configurations")}
+		}
+		for _, f := range []struct{ field, rate string }{{"total", c.Limits.Total}, {"user", c.Limits.User}, {"stream", c.Limits.Stream}} {
+			if _, err := ParseRate(f.rate); err != nil {
+				return &FieldError{"limits." + f.field, err}
+			}
+		}
+		for _, f := range []struct{ field, size string }{{"dailyQuota", c.Limits.DailyQuota}, {"monthlyQuota", c.Limits.MonthlyQuota}} {
+			if _, err := ParseSize(f.size); err != nil {
+				return &FieldError{"limits." + f.field, err}
+			}
+			if f.size != "" && c.UsageFile == "" {
+				return &FieldError{"limits." + f.field, errors.New("requires usageFile to be set, so that usage is kept across restarts")}
+			}
+		}
+		if c.Limits.Streams < 0 {
+			return &FieldError{"limits.streams", errors.New("must not be negative")}
+		}
+		for _, f := range []struct{ field, duration string }{{"idleTimeout", c.Limits.IdleTimeout}, {"maxLifetime", c.Limits.MaxLifetime}} {
+			if f.duration == "" {
+				continue
+			}
+			if d, err := time.ParseDuration(f.duration); err != nil || d <= 0 {
+				return &FieldError{"limits." + f.field, errors.New("must be a duration, such as 30s, 10m or 24h")}
+			}
+		}
+	}
+	for i, u := range c.Users {
+		if _, err := ParseRate(u.Limit); err != nil {
+			return &FieldError{fmt.Sprintf("users[%d].limit", i), err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// maxWeight is the largest weight that a port can be given.
+const maxWeight = 100
+
+// PortWeight returns the weight of streams to a port, as set by the priorities of the configuration.
+// Ports without a priority have a weight of 1.
+func (c *Configuration) PortWeight(port int) int {
+	if weight, ok := c.Priorities[strconv.Itoa(port)]; ok {
+		return weight
+	}
+	return 1
+}
+
+func (c *Configuration) verifyPriorities() error {
+	ports := make([]string, 0, len(c.Priorities))
+	for port := range c.Priorities {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports) // so that the same error is reported every time
+	for _, port := range ports {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 || strconv.Itoa(n) != port {
+			return &FieldError{"priorities." + port, errors.New("must be a port number")}
+		}
+		if weight := c.Priorities[port]; weight < 1 || weight > maxWeight {
+			return &FieldError{"priorities." + port, fmt.Errorf("must be a weight from 1 to %d", maxWeight)}
+		}
+	}
+	return nil
+}
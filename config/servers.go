@@ -0,0 +1,106 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+var selections = []string{"priority", "latency"}
+
+// Server is another server that a client can use instead of the one that the rest of its configuration names, such as
+// a backup that is reached with a different protocol.
+type Server struct {
+	// Name is how the server is referred to in logs and by the control API, instead of by its address.
+	Name string `json:"name,omitempty"`
+
+	// Priority orders the servers when they are chosen by priority, lowest first. The server that the rest of the
+	// configuration names has priority 0, and servers with the same priority are tried in the order they are listed.
+	Priority int `json:"priority,omitempty"`
+
+	Protocol  string       `json:"protocol"`
+	AuthToken string       `json:"authToken"`
+	HTTPS     *HTTPSConfig `json:"https,omitempty"`
+	TCP       *TCPConfig   `json:"tcp,omitempty"`
+}
+
+// Endpoint is one of the servers of a client configuration.
+type Endpoint struct {
+	Name     string // empty unless the server was given one
+	Addr     string // the host and port that the client connects to
+	Priority int
+	Config   *Configuration
+}
+
+// Endpoints returns the server that the configuration names followed by the ones in Servers, each with a
+// configuration of its own. Options that are not specific to a server, such as priorities, are shared by all of them.
+func (c *Configuration) Endpoints() []Endpoint {
+	endpoints := []Endpoint{{Addr: c.ServerAddr(), Config: c}}
+	for _, s := range c.Servers {
+		conf := c.server(s)
+		endpoints = append(endpoints, Endpoint{Name: s.Name, Addr: conf.ServerAddr(), Priority: s.Priority, Config: conf})
+	}
+	return endpoints
+}
+
+// ServerAddr returns the host and port that a client connects to.
+func (c *Configuration) ServerAddr() string {
+	switch {
+	case c.TCP != nil:
+		return net.JoinHostPort(c.TCP.ServerAddr, strconv.Itoa(c.TCP.ServerPort))
+	case c.HTTPS != nil:
+		u, err := url.Parse(c.HTTPS.ProxyAddr)
+		if err != nil {
+			return c.HTTPS.ProxyAddr
+		}
+		if u.Port() == "" {
+			return net.JoinHostPort(u.Hostname(), "443")
+		}
+		return u.Host
+	default:
+		return ""
+	}
+}
+
+// server returns the configuration of a client that uses s.
+func (c *Configuration) server(s Server) *Configuration {
+	return &Configuration{
+		Role:       "client",
+		Protocol:   s.Protocol,
+		AuthToken:  s.AuthToken,
+		HTTPS:      s.HTTPS,
+		TCP:        s.TCP,
+		Priorities: c.Priorities,
+		Keepalive:  c.Keepalive,
+	}
+}
+
+func (c *Configuration) verifyServers() error {
+	if c.Selection != "" && !contains(selections, c.Selection) {
+		return &FieldError{"selection", errors.New("must be one of " + strList(selections))}
+	}
+	if len(c.Servers) == 0 {
+		return nil
+	}
+	if c.Role == "server" {
+		return &FieldError{"servers", errors.New("can only be set in a client configuration")}
+	}
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		conf := c.server(*s)
+		if err := conf.Verify(); err != nil {
+			var fieldErr *FieldError
+			if errors.As(err, &fieldErr) {
+				return &FieldError{fmt.Sprintf("servers[%d].%s", i, fieldErr.Field), fieldErr.Err}
+			}
+			return err
+		}
+		if conf.AuthToken == "" {
+			return &FieldError{fmt.Sprintf("servers[%d].authToken", i), errors.New("must be set")}
+		}
+		s.HTTPS, s.TCP = conf.HTTPS, conf.TCP // with defaults filled in
+	}
+	return nil
+}
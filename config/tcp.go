@@ -2,11 +2,16 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/asaskevich/govalidator"
 )
 
+// maxTunnels is the most connections that a client can keep to a tcp server.
+const maxTunnels = 16
+
 var tcp = specification{
 	protocol: "tcp",
 	options: []option{
@@ -32,5 +37,19 @@ var tcp = specification{
 				return resp, nil
 			},
 		},
+		{
+			key:    "tunnels",
+			prompt: fmt.Sprintf("How many connections should clients keep to the server? Streams are spread across them, and move to another when one fails.\nLeave empty for 1, at most %d.\n> ", maxTunnels),
+			process: func(resp string) (string, error) {
+				resp = strings.TrimSpace(resp)
+				if resp == "" || resp == "1" {
+					return "", nil
+				}
+				if n, err := strconv.Atoi(resp); err != nil || n < 1 || n > maxTunnels {
+					return "", fmt.Errorf("must be a number from 1 to %d", maxTunnels)
+				}
+				return resp, nil
+			},
+		},
 	},
 }
@@ -0,0 +1,29 @@
+package config
+
+import "errors"
+
+func (c *Configuration) verifyUpstream() error {
+	if c.Upstream == nil {
+		return nil
+	}
+	if c.Role == "client" {
+		return &FieldError{"upstream", errors.New("can only be set in a server configuration")}
+	}
+	if c.Upstream.Role == "" {
+		c.Upstream.Role = "client"
+	}
+	if c.Upstream.Role != "client" {
+		return &FieldError{"upstream.role", errors.New("must be client")}
+	}
+	if err := c.Upstream.Verify(); err != nil {
+		var fieldErr *FieldError
+		if errors.As(err, &fieldErr) {
+			return &FieldError{"upstream." + fieldErr.Field, fieldErr.Err}
+		}
+		return err
+	}
+	if c.Upstream.AuthToken == "" {
+		return &FieldError{"upstream.authToken", errors.New("must be set")}
+	}
+	return nil
+}
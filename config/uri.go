@@ -0,0 +1,69 @@
+package config
+
+import (
+	"errors"
+	"net/url"
+)
+
+const uriScheme = "rosen"
+
+// URI returns the client side of the configuration as a single rosen:// URI, which clients can use with -import.
+// The URI contains the key, so it must be shared as carefully as a config file.
+func (c *Configuration) URI() (string, error) {
+	client, err := c.ClientConfig()
+	if err != nil {
+		return "", err
+	}
+	if client.AuthToken == "" {
+		return "", errors.New("config has no authToken; share the config of a user instead")
+	}
+	v, err := toValues(client.section())
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("authToken", client.AuthToken)
+	for key, value := range v {
+		if value != "" && value != "no" { // unset options take their default
+			query.Set(key, value)
+		}
+	}
+
+	return (&url.URL{
+		Scheme:   uriScheme,
+		Host:     client.Protocol,
+		RawQuery: query.Encode(),
+	}).String(), nil
+}
+
+// ParseURI returns the client configuration encoded in a rosen:// URI.
+func ParseURI(uri string) (*Configuration, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != uriScheme {
+		return nil, errors.New("config error: URI must start with " + uriScheme + "://")
+	}
+
+	query := u.Query()
+	conf := &Configuration{
+		Role:      "client",
+		Protocol:  u.Host,
+		AuthToken: query.Get("authToken"),
+	}
+	query.Del("authToken")
+
+	if _, err := specFor(conf.Protocol); err != nil {
+		return nil, &FieldError{"protocol", err}
+	}
+	v := make(values)
+	for key := range query {
+		v[key] = query.Get(key)
+	}
+	if err := fromValues(v, conf.section(), conf.Protocol); err != nil {
+		return nil, err
+	}
+	return conf, conf.Verify()
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// DefaultUser is the name of the user that authenticates with the authToken of a server configuration.
+const DefaultUser = "default"
+
+var userNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// User is a named client of a server, with a key of its own so that it can be revoked individually.
+type User struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+
+	// Limit overrides the user rate of the limits section for this user.
+	Limit string `json:"limit,omitempty"`
+}
+
+// UserKey is a user of a server along with their decoded key.
+type UserKey struct {
+	Name string
+	Key  []byte
+}
+
+// UserKeys returns the keys that are accepted by a server: the authToken as DefaultUser, if it is set, and the key of every user.
+// For a client configuration this is just its authToken.
+func (c *Configuration) UserKeys() ([]UserKey, error) {
+	var keys []UserKey
+	if c.AuthToken != "" {
+		key, err := DecodeKeyString(c.AuthToken)
+		if err != nil {
+			return nil, &FieldError{"authToken", errors.New("must be a base64 encoded 32 byte key")}
+		}
+		keys = append(keys, UserKey{DefaultUser, key})
+	}
+	for i, u := range c.Users {
+		key, err := DecodeKeyString(u.Key)
+		if err != nil {
+			return nil, &FieldError{fmt.Sprintf("users[%d].key", i), errors.New("must be a base64 encoded 32 byte key")}
+		}
+		keys = append(keys, UserKey{u.Name, key})
+	}
+	if len(keys) == 0 {
+		return nil, &FieldError{"authToken", errors.New("must be set")}
+	}
+	return keys, nil
+}
+
+// RevokedUsers returns the names of the users whose key in old is not accepted in new: they were removed, or their
+// key was changed.
+func RevokedUsers(old, new []UserKey) []string {
+	var revoked []string
+	for _, o := range old {
+		accepted := false
+		for _, n := range new {
+			if n.Name == o.Name && bytes.Equal(n.Key, o.Key) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			revoked = append(revoked, o.Name)
+		}
+	}
+	return revoked
+}
+
+// HasUser reports whether a server accepts the key of the named user.
+func (c *Configuration) HasUser(name string) bool {
+	if name == DefaultUser {
+		return c.AuthToken != ""
+	}
+	return c.user(name) != -1
+}
+
+// AddUser adds a user with a freshly generated key.
+func (c *Configuration) AddUser(name string) (*User, error) {
+	if err := verifyUserName(name); err != nil {
+		return nil, err
+	}
+	if c.user(name) != -1 {
+		return nil, errors.New("user " + name + " already exists")
+	}
+	c.Users = append(c.Users, User{Name: name, Key: generateAuthToken()})
+	return &c.Users[len(c.Users)-1], nil
+}
+
+// RemoveUser revokes the key of a user. Removing DefaultUser clears the authToken.
+func (c *Configuration) RemoveUser(name string) error {
+	if name == DefaultUser && c.AuthToken != "" {
+		if len(c.Users) == 0 {
+			return errors.New("cannot remove the only user")
+		}
+		c.AuthToken = ""
+		return nil
+	}
+	i := c.user(name)
+	if i == -1 {
+		return errors.New("no such user: " + name)
+	}
+	if len(c.Users) == 1 && c.AuthToken == "" {
+		return errors.New("cannot remove the only user")
+	}
+	c.Users = append(c.Users[:i], c.Users[i+1:]...)
+	return nil
+}
+
+// UserClientConfig returns the client configuration of a single user of a server.
+func (c *Configuration) UserClientConfig(name string) (*Configuration, error) {
+	token := c.AuthToken
+	if name != DefaultUser {
+		i := c.user(name)
+		if i == -1 {
+			return nil, errors.New("no such user: " + name)
+		}
+		token = c.Users[i].Key
+	}
+	if token == "" {
+		return nil, errors.New("no such user: " + name)
+	}
+
+	conf, err := c.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	conf.AuthToken = token
+	return conf, nil
+}
+
+func (c *Configuration) user(name string) int {
+	for i := range c.Users {
+		if c.Users[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *Configuration) verifyUsers() error {
+	if len(c.Users) > 0 && c.Role == "client" {
+		return &FieldError{"users", errors.New("must only be set in server configurations")}
+	}
+	seen := make(map[string]bool)
+	for i, u := range c.Users {
+		if err := verifyUserName(u.Name); err != nil {
+			return &FieldError{fmt.Sprintf("users[%d].name", i), err}
+		}
+		if seen[u.Name] {
+			return &FieldError{fmt.Sprintf("users[%d].name", i), errors.New("duplicate user " + u.Name)}
+		}
+		seen[u.Name] = true
+	}
+	_, err := c.UserKeys()
+	return err
+}
+
+func verifyUserName(name string) error {
+	if name == DefaultUser {
+		return errors.New(DefaultUser + " is reserved for the authToken")
+	}
+	if !userNamePattern.MatchString(name) {
+		return errors.New("user names must be 1 to 64 letters, digits, dots, dashes or underscores")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// toValues converts the options of a protocol section into their string form, which is what the
+// specification validators operate on. Booleans become yes or no, and zero numbers become empty strings
+// so that the validator fills in the default.
+func toValues(section interface{}) (values, error) {
+	v := make(values)
+	elem := reflect.ValueOf(section).Elem()
+	for i := 0; i < elem.NumField(); i++ {
+		key := jsonName(elem.Type().Field(i))
+		switch field := elem.Field(i); field.Kind() {
+		case reflect.String:
+			v[key] = field.String()
+		case reflect.Bool:
+			v[key] = "no"
+			if field.Bool() {
+				v[key] = "yes"
+			}
+		case reflect.Int:
+			if field.Int() != 0 {
+				v[key] = strconv.FormatInt(field.Int(), 10)
+			}
+		default:
+			return nil, errors.New("unsupported config field type: " + field.Kind().String()) // programming error
+		}
+	}
+	return v, nil
+}
+
+// fromValues sets the fields of a protocol section from their string form.
+// Keys that do not correspond to an option are rejected.
+func fromValues(v values, section interface{}, protocol string) error {
+	elem := reflect.ValueOf(section).Elem()
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < elem.NumField(); i++ {
+		fields[jsonName(elem.Type().Field(i))] = elem.Field(i)
+	}
+
+	for key, value := range v {
+		field, ok := fields[key]
+		if !ok {
+			return &FieldError{protocol + "." + key, errors.New("unknown option")}
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			switch value {
+			case "yes", "true":
+				field.SetBool(true)
+			case "no", "false", "":
+				field.SetBool(false)
+			default:
+				return &FieldError{protocol + "." + key, errors.New("must be yes or no")}
+			}
+		case reflect.Int:
+			if value == "" {
+				field.SetInt(0)
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return &FieldError{protocol + "." + key, errors.New("must be a number")}
+			}
+			field.SetInt(int64(n))
+		default:
+			return errors.New("unsupported config field type: " + field.Kind().String()) // programming error
+		}
+	}
+	return nil
+}
+
+func jsonName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
@@ -0,0 +1,169 @@
+// Package control implements a local API for inspecting a running client or server and closing its sessions and streams.
+// It is served over a unix socket that only the owner of the process can connect to, so no further authentication is done.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/awnumar/rosen/router"
+)
+
+// ErrNotFound is returned by the client when there is no session or stream by the given name.
+var ErrNotFound = errors.New("not found")
+
+// Handler returns the API for node:
+//
+//	GET  /sessions              the sessions and their streams
+//	POST /sessions/close?name=  closes every stream of a session
+//	POST /streams/close?id=     closes a single stream
+func Handler(node router.Inspector) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method must be GET", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(node.Sessions())
+	})
+	mux.HandleFunc("/sessions/close", closeHandler("name", node.CloseSession))
+	mux.HandleFunc("/streams/close", closeHandler("id", node.CloseStream))
+	return mux
+}
+
+func closeHandler(param string, close func(string) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method must be POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if !close(r.URL.Query().Get(param)) {
+			http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListenAndServe serves the API for node on a unix socket at path until ctx is cancelled.
+// A socket left behind by a previous process is replaced.
+func ListenAndServe(ctx context.Context, path string, node router.Inspector) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	srv := &http.Server{Handler: Handler(node)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// listenPrivate listens on a unix socket at path that only the owner can connect to. The socket is created in a
+// directory of its own with mode 0700 and only moved to path once its mode is 0600, so that no other user can
+// connect in between.
+func listenPrivate(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".control-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false) // path is removed by the caller
+	if err := os.Chmod(tmp, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Client talks to the API of a running client or server.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client for the API served on the unix socket at path.
+func NewClient(path string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Sessions returns the sessions and their streams.
+func (c *Client) Sessions() ([]router.SessionInfo, error) {
+	resp, err := c.http.Get("http://rosen/sessions")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+	var sessions []router.SessionInfo
+	return sessions, json.NewDecoder(resp.Body).Decode(&sessions)
+}
+
+// CloseSession closes every stream of a session.
+func (c *Client) CloseSession(name string) error {
+	return c.post("/sessions/close?name=" + url.QueryEscape(name))
+}
+
+// CloseStream closes a single stream.
+func (c *Client) CloseStream(id string) error {
+	return c.post("/streams/close?id=" + url.QueryEscape(id))
+}
+
+func (c *Client) post(path string) error {
+	resp, err := c.http.Post("http://rosen"+path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return statusError(resp)
+	}
+}
+
+func statusError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("control API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,86 @@
+package control
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awnumar/rosen/router"
+
+	"github.com/matryer/is"
+)
+
+type node struct {
+	sessions []router.SessionInfo
+	closed   []string
+}
+
+func (n *node) Sessions() []router.SessionInfo {
+	return n.sessions
+}
+
+func (n *node) CloseSession(name string) bool {
+	n.closed = append(n.closed, "session "+name)
+	return name == "alice"
+}
+
+func (n *node) CloseStream(id string) bool {
+	n.closed = append(n.closed, "stream "+id)
+	return id == "abc"
+}
+
+func TestControl(t *testing.T) {
+	is := is.New(t)
+
+	opened := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	n := &node{sessions: []router.SessionInfo{{
+		Name:  "alice",
+		State: "connected",
+		Streams: []router.StreamInfo{{
+			ID:       "abc",
+			Dest:     router.NewEndpoint("tcp", "example.com:443"),
+			BytesIn:  10,
+			BytesOut: 20,
+			Opened:   opened,
+		}},
+	}}}
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- ListenAndServe(ctx, path, n)
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	info, err := os.Stat(path)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(0600)) // only the owner can connect
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	is.NoErr(err)
+	is.Equal(len(entries), 1) // the directory the socket was created in is removed
+
+	c := NewClient(path)
+	sessions, err := c.Sessions()
+	is.NoErr(err)
+	is.Equal(sessions, n.sessions)
+
+	is.NoErr(c.CloseSession("alice"))
+	is.Equal(c.CloseSession("bob"), ErrNotFound)
+	is.NoErr(c.CloseStream("abc"))
+	is.Equal(c.CloseStream("a&b"), ErrNotFound)
+	is.Equal(n.closed, []string{"session alice", "session bob", "stream abc", "stream a&b"})
+
+	cancel()
+	is.NoErr(<-served)
+	_, err = os.Stat(path)
+	is.True(os.IsNotExist(err)) // the socket is removed
+}
@@ -0,0 +1,82 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes.
+const certFileCheckInterval = 5 * time.Second
+
+// FileCertificate serves a certificate and key loaded from files on disk.
+// The files are reloaded whenever their modification time changes, so that certificates renewed by an external tool are picked up without a restart.
+type FileCertificate struct {
+	certFile string
+	keyFile  string
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewFileCertificate loads the certificate and key from the given PEM files.
+func NewFileCertificate(certFile, keyFile string) (*FileCertificate, error) {
+	c := &FileCertificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate can be used as the GetCertificate callback of a tls.Config.
+func (c *FileCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if time.Since(c.lastCheck) > certFileCheckInterval {
+		c.lastCheck = time.Now()
+		if modTime, err := c.latestModTime(); err == nil && !modTime.Equal(c.modTime) {
+			if err := c.reload(); err != nil {
+				// keep serving the previous certificate until the files are fixed
+				slog.Error("failed to reload TLS certificate", "err", err)
+			}
+		}
+	}
+
+	return c.cert, nil
+}
+
+func (c *FileCertificate) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *FileCertificate) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
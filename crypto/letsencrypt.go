@@ -2,37 +2,35 @@ package crypto
 
 import (
 	"crypto/x509"
-	"errors"
 	"runtime"
 
 	"github.com/foomo/simplecert"
 )
 
-func GetCertificate(hostname, email string, beforeRenew func(), afterRenew func(), failedRenew func(error), shutdown func()) (*simplecert.CertReloader, error) {
+// GetCertificate provisions and renews a certificate from LetsEncrypt. The ACME challenges are served on httpAddr and tlsAddr,
+// so unless those are :80 and :443 traffic on the standard ports has to be forwarded to them.
+func GetCertificate(hostname, email, httpAddr, tlsAddr string, beforeRenew func(), afterRenew func(), failedRenew func(error), shutdown func()) (*simplecert.CertReloader, error) {
 	config := simplecert.Default
 	config.Domains = []string{hostname}
 	config.CacheDir = "/etc/letsencrypt/live/" + hostname
 	config.SSLEmail = email
+	config.HTTPAddress = httpAddr
+	config.TLSAddress = tlsAddr
 	config.WillRenewCertificate = beforeRenew
 	config.DidRenewCertificate = afterRenew
 	config.FailedToRenewCertificate = failedRenew
 	return simplecert.Init(config, shutdown)
 }
 
-func TrustedCertPool(pinRootCA string) (trustPool *x509.CertPool, err error) {
-	if pinRootCA != "yes" && pinRootCA != "no" {
-		return nil, errors.New("config: pinRootCA must be yes or no")
-	}
-	switch pinRootCA {
-	case "yes":
+// TrustedCertPool returns the roots that the client trusts, which are either the LetsEncrypt roots or the system roots.
+func TrustedCertPool(pinRootCA bool) (trustPool *x509.CertPool, err error) {
+	if pinRootCA {
 		trustPool = x509.NewCertPool()
 		if ok := trustPool.AppendCertsFromPEM([]byte(trustedRootPEMs)); !ok {
 			panic("error: could not parse trusted root certificates")
 		}
-	case "no":
-		if runtime.GOOS != "windows" {
-			trustPool, err = x509.SystemCertPool()
-		}
+	} else if runtime.GOOS != "windows" {
+		trustPool, err = x509.SystemCertPool()
 	}
 	return
 }
@@ -0,0 +1,24 @@
+package crypto
+
+import (
+	"golang.org/x/crypto/argon2"
+)
+
+// KDFParams are the Argon2id parameters used to derive a key from a passphrase.
+type KDFParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+}
+
+// DefaultKDFParams follow the second recommended option of RFC 9106.
+var DefaultKDFParams = KDFParams{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+// PassphraseKey derives a key suitable for NewCipher from a passphrase.
+func PassphraseKey(passphrase, salt []byte, params KDFParams) []byte {
+	return argon2.IDKey(passphrase, salt, params.Time, params.Memory, params.Threads, 32)
+}
@@ -0,0 +1,268 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFileName = "ca.pem"
+	caKeyFileName  = "ca-key.pem"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 365 * 24 * time.Hour
+
+	// How long before it expires a certificate issued by IssuedCertificate is replaced.
+	leafRenewBefore = 30 * 24 * time.Hour
+)
+
+// CA is a self-managed certificate authority used to issue server certificates when no public CA is available.
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// LoadOrCreateCA loads the CA stored in dir, generating and saving a new one if none exists yet.
+func LoadOrCreateCA(dir string) (*CA, error) {
+	certPath := filepath.Join(dir, caCertFileName)
+	keyPath := filepath.Join(dir, caKeyFileName)
+
+	certPEM, certErr := ioutil.ReadFile(certPath)
+	keyPEM, keyErr := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return createCA(dir, certPath, keyPath)
+	}
+	if certErr != nil {
+		return nil, certErr
+	}
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, errors.New("error: failed to decode CA certificate " + certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("error: failed to decode CA key " + keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{cert: cert, key: key}, nil
+}
+
+func createCA(dir, certPath, keyPath string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Rosen CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, err
+	}
+
+	return &CA{cert: cert, key: key}, nil
+}
+
+// Fingerprint returns the hex-encoded SHA-256 hash of the CA certificate.
+// Clients pin this value in their configuration.
+func (ca *CA) Fingerprint() string {
+	return Fingerprint(ca.cert.Raw)
+}
+
+// Issue generates a fresh key and returns a certificate for hostname signed by the CA.
+// The CA certificate is included in the chain so that clients can verify it against their pinned fingerprint.
+func (ca *CA) Issue(hostname string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(hostname); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{hostname}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+// IssuedCertificate serves a certificate issued by a CA, and issues a new one before it expires, so that long-running
+// servers do not need to be restarted.
+type IssuedCertificate struct {
+	ca       *CA
+	hostname string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	renewAt time.Time
+}
+
+// NewIssuedCertificate issues a certificate for hostname from ca.
+func (ca *CA) NewIssuedCertificate(hostname string) (*IssuedCertificate, error) {
+	c := &IssuedCertificate{
+		ca:       ca,
+		hostname: hostname,
+	}
+	if err := c.renew(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate can be used as the GetCertificate callback of a tls.Config.
+func (c *IssuedCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if time.Now().After(c.renewAt) {
+		if err := c.renew(); err != nil {
+			// keep serving the previous certificate, which is still valid, and try again on the next handshake
+			slog.Error("failed to renew TLS certificate", "err", err)
+		}
+	}
+
+	return c.cert, nil
+}
+
+func (c *IssuedCertificate) renew() error {
+	cert, err := c.ca.Issue(c.hostname)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	c.cert = cert
+	c.renewAt = leaf.NotAfter.Add(-leafRenewBefore)
+	return nil
+}
+
+// Fingerprint returns the hex-encoded SHA-256 hash of a DER-encoded certificate.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyPinnedCA returns a callback for tls.Config.VerifyPeerCertificate that accepts a server certificate for hostname
+// only if it chains to a CA certificate with the given fingerprint. It is meant to be used with InsecureSkipVerify set,
+// since the system roots are bypassed entirely.
+func VerifyPinnedCA(fingerprint, hostname string) func([][]byte, [][]*x509.Certificate) error {
+	fingerprint = strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("error: server did not present a certificate")
+		}
+
+		roots := x509.NewCertPool()
+		intermediates := x509.NewCertPool()
+		pinned := false
+		for _, raw := range rawCerts[1:] {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			if subtle.ConstantTimeCompare([]byte(Fingerprint(raw)), []byte(fingerprint)) == 1 {
+				roots.AddCert(cert)
+				pinned = true
+			} else {
+				intermediates.AddCert(cert)
+			}
+		}
+		if !pinned {
+			return errors.New("error: server certificate chain does not contain the pinned CA")
+		}
+
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{
+			DNSName:       hostname,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
+
+func randSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,53 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestSelfSignedCA(t *testing.T) {
+	is := is.New(t)
+
+	dir := t.TempDir()
+
+	ca, err := LoadOrCreateCA(dir)
+	is.NoErr(err)
+
+	loaded, err := LoadOrCreateCA(dir)
+	is.NoErr(err)
+	is.Equal(ca.Fingerprint(), loaded.Fingerprint()) // CA should persist across loads
+
+	cert, err := ca.Issue("example.com")
+	is.NoErr(err)
+
+	is.NoErr(VerifyPinnedCA(ca.Fingerprint(), "example.com")(cert.Certificate, nil))
+	is.True(VerifyPinnedCA(ca.Fingerprint(), "example.org")(cert.Certificate, nil) != nil) // wrong hostname
+
+	other, err := LoadOrCreateCA(t.TempDir())
+	is.NoErr(err)
+	is.True(VerifyPinnedCA(other.Fingerprint(), "example.com")(cert.Certificate, nil) != nil) // wrong CA
+}
+
+func TestIssuedCertificate(t *testing.T) {
+	is := is.New(t)
+
+	ca, err := LoadOrCreateCA(t.TempDir())
+	is.NoErr(err)
+	issued, err := ca.NewIssuedCertificate("example.com")
+	is.NoErr(err)
+
+	first, err := issued.GetCertificate(nil)
+	is.NoErr(err)
+	again, err := issued.GetCertificate(nil)
+	is.NoErr(err)
+	is.Equal(again, first) // still fresh
+
+	issued.renewAt = time.Now().Add(-time.Minute) // about to expire
+	renewed, err := issued.GetCertificate(nil)
+	is.NoErr(err)
+	is.True(renewed != first)
+	is.NoErr(VerifyPinnedCA(ca.Fingerprint(), "example.com")(renewed.Certificate, nil))
+	is.True(issued.renewAt.After(time.Now().Add(300 * 24 * time.Hour)))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/awnumar/rosen/control"
+)
+
+var ctlActions = []string{"status", "kill-session", "kill-stream"}
+
+// ctl implements the ctl subcommand, which talks to the control socket of a running client or server:
+//
+//	rosen ctl status -control rosen.sock
+//	rosen ctl kill-session|kill-stream -control rosen.sock <name or id>
+func ctl(args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	path := fs.String("control", "", "Path to the control socket given to the running client or server")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s ctl status -control rosen.sock\n", os.Args[0])
+		fmt.Printf("       %s ctl kill-session|kill-stream -control rosen.sock <name or id>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 || !contains(ctlActions, args[0]) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+
+	if *path == "" {
+		return fmt.Errorf("control socket must be specified with -control")
+	}
+	target := fs.Arg(0)
+	if action != "status" && target == "" {
+		return fmt.Errorf("session name or stream ID must be specified")
+	}
+
+	c := control.NewClient(*path)
+	switch action {
+	case "status":
+		sessions, err := c.Sessions()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, sess := range sessions {
+			if sess.Server != "" {
+				fmt.Fprintf(w, "session %s (%s via %s), %d streams\n", sess.Name, sess.State, sess.Server, len(sess.Streams))
+			} else {
+				fmt.Fprintf(w, "session %s (%s), %d streams\n", sess.Name, sess.State, len(sess.Streams))
+			}
+			if len(sess.Streams) > 0 {
+				fmt.Fprintln(w, "  ID\tDEST\tIN\tOUT\tAGE")
+			}
+			for _, s := range sess.Streams {
+				fmt.Fprintf(w, "  %s\t%s %s\t%d\t%d\t%s\n", s.ID, s.Dest.Network, s.Dest.Address, s.BytesIn, s.BytesOut, time.Since(s.Opened).Round(time.Second))
+			}
+		}
+		return w.Flush()
+	case "kill-session":
+		if err := c.CloseSession(target); err != nil {
+			return fmt.Errorf("session %s: %w", target, err)
+		}
+		fmt.Println("Closed the streams of session", target)
+	case "kill-stream":
+		if err := c.CloseStream(target); err != nil {
+			return fmt.Errorf("stream %s: %w", target, err)
+		}
+		fmt.Println("Closed stream", target)
+	}
+	return nil
+}
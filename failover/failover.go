@@ -0,0 +1,387 @@
+// Package failover implements a client that has several servers to choose from. It uses one at a time, checks that the
+// others can be reached, and switches to another when the one in use fails.
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/logging"
+	"github.com/awnumar/rosen/router"
+)
+
+const (
+	// How often the servers are checked.
+	defaultCheckInterval = 30 * time.Second
+
+	// How long a check waits for a server to accept a connection.
+	probeTimeout = 5 * time.Second
+
+	// How long the server in use can go without a working session before another is chosen.
+	switchAfter = 30 * time.Second
+
+	// How long a server whose session failed is passed over, even if it can be reached.
+	holdDown = time.Minute
+
+	// How long the client of a server that was switched away from is given to close its streams.
+	drainTimeout = 10 * time.Second
+)
+
+// ErrNoServer is returned by NewClient when there is no server to start.
+var ErrNoServer = errors.New("no server is available")
+
+// NewClientFunc starts a client of the server that conf names.
+type NewClientFunc func(conf *config.Configuration) (router.Client, error)
+
+// ProbeFunc checks that a server accepts connections at addr, and returns how long it took.
+type ProbeFunc func(ctx context.Context, addr string) (time.Duration, error)
+
+// Client is a router.Client that uses one of several servers at a time. Servers are chosen by priority, or by the
+// time it takes to connect to them, among those that could be reached when they were last checked. When the session
+// with the server in use fails, or goes without working for too long, the client switches to the next server, and the
+// streams that were open are closed. When choosing by priority, the client goes back to a preferred server once it
+// is idle.
+type Client struct {
+	servers   []*server
+	latency   bool
+	newClient NewClientFunc
+	probe     ProbeFunc
+	interval  time.Duration
+	logger    *slog.Logger
+
+	mutex  sync.Mutex // guards active and client
+	active *server    // nil until a server has been started
+	client router.Client
+
+	since        time.Time // when the session with the server in use last worked, or was started
+	stateChanges chan router.StateChange
+	stop         chan struct{} // closed by Shutdown
+	stopped      chan struct{} // closed by run when it returns
+}
+
+type server struct {
+	config.Endpoint
+	index     int
+	rtt       time.Duration // of the latest check
+	reachable bool
+	downUntil time.Time // when a server whose session failed can be chosen again
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithLogger sets the logger that switches between servers are reported to.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithProbe replaces how servers are checked, which by default is by opening a TCP connection to them.
+func WithProbe(probe ProbeFunc) Option {
+	return func(c *Client) {
+		c.probe = probe
+	}
+}
+
+// WithCheckInterval sets how often the servers are checked. The default is 30 seconds.
+func WithCheckInterval(d time.Duration) Option {
+	return func(c *Client) {
+		c.interval = d
+	}
+}
+
+// NewClient checks the servers of conf and starts a client of the best one with newClient. It fails if none of them
+// can be started.
+func NewClient(conf *config.Configuration, newClient NewClientFunc, opts ...Option) (*Client, error) {
+	c := &Client{
+		latency:      conf.Selection == "latency",
+		newClient:    newClient,
+		probe:        dial,
+		interval:     defaultCheckInterval,
+		logger:       slog.Default(),
+		stateChanges: make(chan router.StateChange, 16),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	for i, e := range conf.Endpoints() {
+		c.servers = append(c.servers, &server{Endpoint: e, index: i})
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.check()
+	if err := c.choose(); err != nil {
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// dial checks a server by opening a TCP connection to it.
+func dial(ctx context.Context, addr string) (time.Duration, error) {
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
+
+// run watches the session with the server in use and checks the servers, until Shutdown.
+func (c *Client) run() {
+	defer close(c.stopped)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		var changes <-chan router.StateChange
+		if notifier, ok := c.current().(router.StateNotifier); ok {
+			changes = notifier.StateChanges()
+		}
+		select {
+		case <-c.stop:
+			return
+		case change := <-changes:
+			select {
+			case c.stateChanges <- change:
+			default:
+			}
+			if change.State == router.Connected {
+				c.since = time.Now()
+			}
+			if change.State == router.Failed {
+				c.fail(change.Err)
+			}
+		case <-ticker.C:
+			c.check()
+			c.review()
+		}
+	}
+}
+
+// check probes every server at once.
+func (c *Client) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range c.servers {
+		wg.Add(1)
+		go func(s *server) {
+			defer wg.Done()
+			rtt, err := c.probe(ctx, s.Addr)
+			s.rtt, s.reachable = rtt, err == nil
+			if err != nil {
+				c.logger.Debug("server check failed", append(s.attrs(), logging.Err(err))...)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// review switches away from the server in use if its session has not worked for too long, or, when choosing by
+// priority, back to a preferred server if the client is idle.
+func (c *Client) review() {
+	if c.state() == router.Connected {
+		c.since = time.Now()
+	} else if time.Since(c.since) > switchAfter {
+		c.fail(fmt.Errorf("session has not worked for %s", switchAfter))
+		return
+	}
+
+	if c.latency || !c.idle() {
+		return
+	}
+	best := c.ranked()[0]
+	if best != c.active && best.reachable && best.before(c.active) {
+		c.logger.Info("preferred server is back", best.attrs()...)
+		if err := c.use(best); err != nil {
+			c.logger.Warn("failed to start client", append(best.attrs(), logging.Err(err))...)
+			best.downUntil = time.Now().Add(holdDown)
+		}
+	}
+}
+
+// fail passes over the server in use for a while, and switches to another. The server in use is only started again
+// if no other can be.
+func (c *Client) fail(err error) {
+	c.logger.Warn("server failed", append(c.active.attrs(), logging.Err(err))...)
+	c.active.downUntil = time.Now().Add(holdDown)
+	if err := c.choose(); err != nil {
+		c.logger.Error("no server is available, trying again later", logging.Err(err))
+		c.since = time.Now()
+	}
+}
+
+// choose switches to the best server that can be started.
+func (c *Client) choose() error {
+	err := ErrNoServer
+	for _, s := range c.ranked() {
+		if err = c.use(s); err == nil {
+			return nil
+		}
+		c.logger.Warn("failed to start client", append(s.attrs(), logging.Err(err))...)
+		s.downUntil = time.Now().Add(holdDown)
+	}
+	return err
+}
+
+// use starts a client of s and switches to it. The client of the server that was in use is shut down.
+func (c *Client) use(s *server) error {
+	client, err := c.newClient(s.Config)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	old, switched := c.client, c.active != nil && c.active != s
+	c.active, c.client = s, client
+	c.mutex.Unlock()
+	c.since = time.Now()
+	if switched {
+		switches.With().Inc()
+	}
+	if old != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+			old.Shutdown(ctx)
+		}()
+	}
+
+	attrs := append(s.attrs(), slog.String("protocol", s.Config.Protocol))
+	if s.reachable {
+		attrs = append(attrs, slog.Duration("rtt", s.rtt))
+	}
+	c.logger.Info("using server", attrs...)
+	return nil
+}
+
+// ranked returns the servers from best to worst. Servers that could be reached and have not failed lately come first.
+func (c *Client) ranked() []*server {
+	now := time.Now()
+	ranked := append([]*server(nil), c.servers...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		aUp, bUp := a.reachable && now.After(a.downUntil), b.reachable && now.After(b.downUntil)
+		if aUp != bUp {
+			return aUp
+		}
+		if c.latency && a.reachable && b.reachable {
+			return a.rtt < b.rtt
+		}
+		return a.before(b)
+	})
+	return ranked
+}
+
+// before reports whether s is preferred to other when choosing by priority.
+func (s *server) before(other *server) bool {
+	if s.Priority != other.Priority {
+		return s.Priority < other.Priority
+	}
+	return s.index < other.index
+}
+
+func (s *server) attrs() []any {
+	attrs := []any{logging.Peer(s.Addr)}
+	if s.Name != "" {
+		attrs = append(attrs, logging.Server(s.Name))
+	}
+	return attrs
+}
+
+// current returns the client of the server in use.
+func (c *Client) current() router.Client {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.client
+}
+
+func (c *Client) state() router.State {
+	if notifier, ok := c.current().(router.StateNotifier); ok {
+		return notifier.State()
+	}
+	return router.Connected
+}
+
+// idle reports whether the client of the server in use has no open streams.
+func (c *Client) idle() bool {
+	inspector, ok := c.current().(router.Inspector)
+	if !ok {
+		return false
+	}
+	for _, sess := range inspector.Sessions() {
+		if len(sess.Streams) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// HandleConnection proxies a connection through the server in use.
+func (c *Client) HandleConnection(dest router.Endpoint, conn net.Conn) error {
+	return c.current().HandleConnection(dest, conn)
+}
+
+// Shutdown stops switching between servers, and closes the open streams of the server in use.
+func (c *Client) Shutdown(ctx context.Context) error {
+	close(c.stop)
+	<-c.stopped
+	return c.current().Shutdown(ctx)
+}
+
+// Server returns the name of the server in use, or its address if it has no name.
+func (c *Client) Server() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.active.Name != "" {
+		return c.active.Name
+	}
+	return c.active.Addr
+}
+
+// State returns the state of the session with the server in use.
+func (c *Client) State() router.State {
+	return c.state()
+}
+
+// StateChanges returns a channel on which changes to the state of the session with the server in use are reported.
+// Changes are dropped if the channel is not being read from.
+func (c *Client) StateChanges() <-chan router.StateChange {
+	return c.stateChanges
+}
+
+// Sessions returns the session with the server in use.
+func (c *Client) Sessions() []router.SessionInfo {
+	inspector, ok := c.current().(router.Inspector)
+	if !ok {
+		return nil
+	}
+	sessions := inspector.Sessions()
+	for i := range sessions {
+		sessions[i].Server = c.Server()
+	}
+	return sessions
+}
+
+// CloseSession closes every stream of the session with the server in use.
+func (c *Client) CloseSession(name string) bool {
+	inspector, ok := c.current().(router.Inspector)
+	return ok && inspector.CloseSession(name)
+}
+
+// CloseStream closes a single stream.
+func (c *Client) CloseStream(id string) bool {
+	inspector, ok := c.current().(router.Inspector)
+	return ok && inspector.CloseStream(id)
+}
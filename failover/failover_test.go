@@ -0,0 +1,178 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/router"
+
+	"github.com/matryer/is"
+)
+
+// fakeClient stands in for the client of a server, whose session state is set by the test.
+type fakeClient struct {
+	mutex   sync.Mutex
+	state   router.State
+	changes chan router.StateChange
+	closed  bool
+}
+
+func (f *fakeClient) setState(state router.State) {
+	f.mutex.Lock()
+	f.state = state
+	f.mutex.Unlock()
+	f.changes <- router.StateChange{State: state, Err: errors.New("test")}
+}
+
+func (f *fakeClient) State() router.State {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.state
+}
+
+func (f *fakeClient) StateChanges() <-chan router.StateChange { return f.changes }
+
+func (f *fakeClient) HandleConnection(router.Endpoint, net.Conn) error { return nil }
+
+func (f *fakeClient) Shutdown(context.Context) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeClient) Sessions() []router.SessionInfo {
+	return []router.SessionInfo{{Name: router.ClientSession, State: f.State().String()}}
+}
+
+func (f *fakeClient) CloseSession(string) bool { return true }
+
+func (f *fakeClient) CloseStream(string) bool { return false }
+
+// fakeServers starts fake clients, and answers checks with the round-trip times that are set, failing for servers
+// that have none.
+type fakeServers struct {
+	mutex   sync.Mutex
+	rtts    map[string]time.Duration
+	clients []*fakeClient
+}
+
+func (f *fakeServers) newClient(conf *config.Configuration) (router.Client, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	c := &fakeClient{state: router.Connected, changes: make(chan router.StateChange, 16)}
+	f.clients = append(f.clients, c)
+	return c, nil
+}
+
+func (f *fakeServers) probe(_ context.Context, addr string) (time.Duration, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if rtt, ok := f.rtts[addr]; ok {
+		return rtt, nil
+	}
+	return 0, errors.New("unreachable")
+}
+
+func (f *fakeServers) setRTT(addr string, rtt time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rtts[addr] = rtt
+}
+
+func (f *fakeServers) last() *fakeClient {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.clients[len(f.clients)-1]
+}
+
+func testConfig(selection string) *config.Configuration {
+	return &config.Configuration{
+		Role:      "client",
+		Protocol:  "tcp",
+		TCP:       &config.TCPConfig{ServerAddr: "10.0.0.1", ServerPort: 8080},
+		Selection: selection,
+		Servers: []config.Server{
+			{Name: "backup", Priority: 1, Protocol: "https", HTTPS: &config.HTTPSConfig{ProxyAddr: "https://backup.example.com"}},
+			{Name: "spare", Priority: 1, Protocol: "tcp", TCP: &config.TCPConfig{ServerAddr: "10.0.0.3", ServerPort: 8080}},
+		},
+	}
+}
+
+func waitFor(is *is.I, cond func() bool) {
+	is.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		is.True(time.Now().Before(deadline)) // timed out
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	is := is.New(t)
+
+	servers := &fakeServers{rtts: map[string]time.Duration{
+		"10.0.0.1:8080":          30 * time.Millisecond,
+		"backup.example.com:443": 20 * time.Millisecond,
+		"10.0.0.3:8080":          10 * time.Millisecond,
+	}}
+	c, err := NewClient(testConfig(""), servers.newClient, WithProbe(servers.probe), WithCheckInterval(time.Hour))
+	is.NoErr(err)
+	is.Equal(c.Server(), "10.0.0.1:8080") // the highest priority
+	is.Equal(c.Sessions()[0].Server, "10.0.0.1:8080")
+
+	first := servers.last()
+	first.setState(router.Failed)
+	waitFor(is, func() bool { return c.Server() == "backup" }) // listed before spare
+	is.True(first.State() == router.Failed)
+	waitFor(is, func() bool {
+		first.mutex.Lock()
+		defer first.mutex.Unlock()
+		return first.closed
+	})
+
+	servers.last().setState(router.Failed)
+	waitFor(is, func() bool { return c.Server() == "spare" })
+
+	is.NoErr(c.Shutdown(context.Background()))
+}
+
+func TestLatency(t *testing.T) {
+	is := is.New(t)
+
+	servers := &fakeServers{rtts: map[string]time.Duration{
+		"10.0.0.1:8080":          30 * time.Millisecond,
+		"backup.example.com:443": 20 * time.Millisecond,
+		"10.0.0.3:8080":          10 * time.Millisecond,
+	}}
+	c, err := NewClient(testConfig("latency"), servers.newClient, WithProbe(servers.probe), WithCheckInterval(time.Hour))
+	is.NoErr(err)
+	is.Equal(c.Server(), "spare")
+
+	servers.last().setState(router.Failed)
+	waitFor(is, func() bool { return c.Server() == "backup" })
+
+	is.NoErr(c.Shutdown(context.Background()))
+}
+
+func TestUnreachable(t *testing.T) {
+	is := is.New(t)
+
+	servers := &fakeServers{rtts: map[string]time.Duration{
+		"10.0.0.3:8080": 10 * time.Millisecond,
+	}}
+	c, err := NewClient(testConfig(""), servers.newClient, WithProbe(servers.probe), WithCheckInterval(10*time.Millisecond))
+	is.NoErr(err)
+	is.Equal(c.Server(), "spare") // the only one that can be reached
+
+	// Once the preferred server can be reached, the idle client goes back to it.
+	servers.setRTT("10.0.0.1:8080", 10*time.Millisecond)
+	waitFor(is, func() bool { return c.Server() == "10.0.0.1:8080" })
+
+	is.NoErr(c.Shutdown(context.Background()))
+}
@@ -0,0 +1,5 @@
+package failover
+
+import "github.com/awnumar/rosen/metrics"
+
+var switches = metrics.Default.NewCounter("rosen_failover_switches_total", "Times that a client switched to another of its servers.")
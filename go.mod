@@ -1,6 +1,6 @@
 module github.com/awnumar/rosen
 
-go 1.17
+go 1.21
 
 require (
 	github.com/asaskevich/govalidator v0.0.0-20210307081110-f21760c49a8d
@@ -9,7 +9,11 @@ require (
 	github.com/foomo/simplecert v1.8.3
 	github.com/hashicorp/go-retryablehttp v0.7.0
 	github.com/matryer/is v1.4.0
+	github.com/mdp/qrterminal/v3 v3.0.0
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324
 	lukechampine.com/frand v1.4.2
 )
 
@@ -92,11 +96,9 @@ require (
 	github.com/vultr/govultr v1.1.1 // indirect
 	go.opencensus.io v0.22.5 // indirect
 	go.uber.org/ratelimit v0.1.0 // indirect
-	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110 // indirect
 	golang.org/x/oauth2 v0.0.0-20210113205817-d3ed898aa8a3 // indirect
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
 	golang.org/x/text v0.3.5 // indirect
-	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324 // indirect
 	google.golang.org/api v0.36.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/genproto v0.0.0-20210119180700-e258113e47cc // indirect
@@ -107,4 +109,5 @@ require (
 	gopkg.in/square/go-jose.v2 v2.5.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
+	rsc.io/qr v0.2.0 // indirect
 )
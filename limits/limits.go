@@ -0,0 +1,140 @@
+// Package limits builds the limiters, stream limits and meters of the routers of a server from its configuration, and
+// keeps them up to date as it is reloaded.
+package limits
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/logging"
+	"github.com/awnumar/rosen/router"
+	"github.com/awnumar/rosen/usage"
+)
+
+// How often the usage of users is saved.
+const usageSaveInterval = time.Minute
+
+// Limits holds the limiters and quotas of a server, as set by the limits section of its configuration and the limits
+// of its users. Usage is only accounted for if the configuration has a usage file.
+type Limits struct {
+	total  *router.Limiter
+	stream *router.Limiter
+	usage  *usage.Store
+
+	mutex   sync.Mutex
+	conf    *config.Configuration
+	users   map[string]*router.Limiter
+	streams router.StreamLimits
+}
+
+// New returns the limiters for conf, and loads the usage so far.
+func New(conf *config.Configuration) (*Limits, error) {
+	l := &Limits{
+		total:   router.NewLimiter(conf.TotalRate()),
+		stream:  router.NewLimiter(conf.StreamRate()),
+		conf:    conf,
+		users:   make(map[string]*router.Limiter),
+		streams: streamLimitsOf(conf),
+	}
+	if conf.UsageFile != "" {
+		store, err := usage.Open(conf.UsageFile)
+		if err != nil {
+			return nil, err
+		}
+		store.SetQuotas(conf.DailyQuota(), conf.MonthlyQuota())
+		l.usage = store
+	}
+	return l, nil
+}
+
+// Update applies the limits of a reloaded configuration to the routers that use them.
+// A changed stream limit or priority only applies to streams that are opened afterwards.
+func (l *Limits) Update(conf *config.Configuration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.conf = conf
+	l.streams = streamLimitsOf(conf)
+	l.total.SetRate(conf.TotalRate())
+	l.stream.SetRate(conf.StreamRate())
+	if l.usage != nil {
+		l.usage.SetQuotas(conf.DailyQuota(), conf.MonthlyQuota())
+	}
+	for name, user := range l.users {
+		user.SetRate(conf.UserRate(name))
+	}
+}
+
+// Options returns the options for the router of a user, which apply the limits to it.
+func (l *Limits) Options(user string) []router.Option {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	limiter, ok := l.users[user]
+	if !ok {
+		limiter = router.NewLimiter(l.conf.UserRate(user))
+		l.users[user] = limiter
+	}
+	opts := []router.Option{
+		router.WithLimiter(limiter),
+		router.WithLimiter(l.total),
+		router.WithStreamLimit(l.stream),
+		router.WithStreamLimits(l.streamLimits),
+		router.WithPriorities(l.portWeight),
+	}
+	if l.usage != nil {
+		opts = append(opts, router.WithMeter(l.usage.Meter(user)))
+	}
+	return opts
+}
+
+func (l *Limits) streamLimits() router.StreamLimits {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.streams
+}
+
+// portWeight returns the weight of streams to a port, as set by the latest configuration.
+func (l *Limits) portWeight(port int) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.conf.PortWeight(port)
+}
+
+func streamLimitsOf(conf *config.Configuration) router.StreamLimits {
+	idle, lifetime := conf.StreamTimeouts()
+	return router.StreamLimits{
+		MaxStreams:  conf.MaxStreams(),
+		IdleTimeout: idle,
+		MaxLifetime: lifetime,
+	}
+}
+
+// KeepUsage saves the usage every usageSaveInterval until ctx is done, and logs errors.
+func (l *Limits) KeepUsage(ctx context.Context, logger *slog.Logger) {
+	if l.usage == nil {
+		return
+	}
+	ticker := time.NewTicker(usageSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.usage.Save(); err != nil {
+				logger.Error("failed to save usage", logging.Err(err))
+			}
+		}
+	}
+}
+
+// SaveUsage writes the usage so far to the usage file, if there is one. Servers call it periodically and when
+// they shut down.
+func (l *Limits) SaveUsage() error {
+	if l.usage == nil {
+		return nil
+	}
+	return l.usage.Save()
+}
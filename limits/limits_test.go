@@ -0,0 +1,44 @@
+package limits
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/router"
+)
+
+func TestLimits(t *testing.T) {
+	is := is.New(t)
+
+	conf := &config.Configuration{
+		Role:      "server",
+		UsageFile: filepath.Join(t.TempDir(), "usage.json"),
+		Limits:    &config.Limits{Streams: 1, DailyQuota: "1KB"},
+	}
+	l, err := New(conf)
+	is.NoErr(err)
+	is.Equal(l.streamLimits().MaxStreams, 1)
+
+	// The routers of users are metered against the quota.
+	l.usage.Meter("alice").Add(2048, 0)
+	r := router.NewRouter(l.Options("alice")...)
+	defer r.Reset()
+	local, remote := net.Pipe()
+	defer local.Close()
+	is.True(r.HandleConnection(router.NewEndpoint("tcp", "example.com:80"), remote) != nil) // over quota
+
+	updated := *conf
+	updated.Limits = &config.Limits{Streams: 2}
+	l.Update(&updated)
+	is.Equal(l.streamLimits().MaxStreams, 2)
+	is.NoErr(r.HandleConnection(router.NewEndpoint("tcp", "example.com:80"), remote)) // no quota any more
+
+	is.NoErr(l.SaveUsage())
+	_, err = os.Stat(conf.UsageFile)
+	is.NoErr(err)
+}
@@ -0,0 +1,130 @@
+// Package logging sets up the structured logger shared by the client and server, and defines the keys of the
+// attributes that are logged.
+package logging
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Keys of the attributes that are logged.
+const (
+	// DestKey is the address that a stream is opened to.
+	DestKey = "dest"
+
+	// PeerKey is the network address of the other end of a tunnel.
+	PeerKey = "peer"
+
+	// UserKey is the name of the user that a tunnel belongs to.
+	UserKey = "user"
+
+	// StreamKey is the ID of a stream.
+	StreamKey = "stream"
+
+	// ServerKey is the name given to one of the servers of a client.
+	ServerKey = "server"
+
+	// ErrKey is an error.
+	ErrKey = "err"
+)
+
+// Redacted replaces the value of addresses in privacy mode.
+const Redacted = "[redacted]"
+
+// Options configures the logger returned by New.
+type Options struct {
+	// Level is one of debug, info, warn or error.
+	Level string
+
+	// Format is text or json.
+	Format string
+
+	// Privacy redacts destination and peer addresses, and replaces errors, which may mention them, with their class.
+	Privacy bool
+}
+
+// New returns a logger that writes to w.
+func New(w io.Writer, opts Options) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+		return nil, errors.New("log level must be one of debug, info, warn or error")
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	if opts.Privacy {
+		handlerOpts.ReplaceAttr = redact
+	}
+
+	switch opts.Format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, errors.New("log format must be text or json")
+	}
+}
+
+func redact(_ []string, a slog.Attr) slog.Attr {
+	switch a.Key {
+	case DestKey, PeerKey:
+		return slog.String(a.Key, Redacted)
+	case ErrKey:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, ErrorClass(err))
+		}
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// ErrorClass sorts an error into one of a handful of classes, which say what went wrong without saying where: dns,
+// refused, unreachable, timeout, eof, closed or other.
+func ErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case os.IsTimeout(err):
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, net.ErrClosed), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "closed"
+	default:
+		return "other"
+	}
+}
+
+// Dest returns the attribute for the address that a stream is opened to.
+func Dest(address string) slog.Attr {
+	return slog.String(DestKey, address)
+}
+
+// Peer returns the attribute for the network address of the other end of a tunnel.
+func Peer(address string) slog.Attr {
+	return slog.String(PeerKey, address)
+}
+
+// User returns the attribute for the name of a user.
+func User(name string) slog.Attr {
+	return slog.String(UserKey, name)
+}
+
+// Server returns the attribute for the name of one of the servers of a client.
+func Server(name string) slog.Attr {
+	return slog.String(ServerKey, name)
+}
+
+// Err returns the attribute for an error.
+func Err(err error) slog.Attr {
+	return slog.Any(ErrKey, err)
+}
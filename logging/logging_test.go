@@ -0,0 +1,65 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestPrivacy(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{Level: "debug", Format: "json", Privacy: true})
+	is.NoErr(err)
+
+	logger.Debug("stream opened", Dest("example.com:443"), Peer("192.0.2.1:5000"), User("alice"))
+	var entry map[string]string
+	is.NoErr(json.Unmarshal(buf.Bytes(), &entry))
+	is.Equal(entry[DestKey], Redacted)
+	is.Equal(entry[PeerKey], Redacted)
+	is.Equal(entry[UserKey], "alice")
+
+	// Errors may mention addresses too, so only their class is logged.
+	refused := closedAddress(is)
+	_, dialErr := net.Dial("tcp", refused)
+	is.True(dialErr != nil)
+	dnsErr := &net.DNSError{Err: "no such host", Name: "secret.example.com"}
+	wrapped := fmt.Errorf("tunnel to %s failed: %w", refused, io.ErrUnexpectedEOF)
+	for err, class := range map[error]string{dialErr: "refused", dnsErr: "dns", wrapped: "eof", errors.New(refused): "other"} {
+		buf.Reset()
+		logger.Warn("failed to open stream", Dest(refused), Err(err))
+		is.NoErr(json.Unmarshal(buf.Bytes(), &entry))
+		is.Equal(entry[ErrKey], class)
+		is.True(!strings.Contains(buf.String(), "127.0.0.1")) // no address anywhere
+		is.True(!strings.Contains(buf.String(), "secret"))
+	}
+
+	buf.Reset()
+	logger, err = New(&buf, Options{Level: "warn", Format: "text"})
+	is.NoErr(err)
+	logger.Info("not logged")
+	is.Equal(buf.Len(), 0)
+	logger.Warn("logged", Dest("example.com:443"), Err(errors.New("failed")))
+	is.True(strings.HasSuffix(buf.String(), "level=WARN msg=logged dest=example.com:443 err=failed\n"))
+
+	_, err = New(&buf, Options{Level: "verbose", Format: "text"})
+	is.True(err != nil)
+	_, err = New(&buf, Options{Level: "info", Format: "xml"})
+	is.True(err != nil)
+}
+
+// closedAddress returns an address that nothing listens on.
+func closedAddress(is *is.I) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer listener.Close()
+	return listener.Addr().String()
+}
@@ -1,51 +1,127 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/control"
+	"github.com/awnumar/rosen/logging"
+	"github.com/awnumar/rosen/metrics"
+	"github.com/awnumar/rosen/router"
+
+	"github.com/mdp/qrterminal/v3"
 )
 
 var (
 	modes = []string{"client", "server"}
 
 	configure bool
+	export    bool
 
 	mode       string
 	configFile string
+	importURI  string
+
+	socksPort    int
+	drainTimeout time.Duration
+	metricsAddr  string
+	controlPath  string
 
-	socksPort int
+	logOpts logging.Options
+	logger  *slog.Logger
 )
 
+// subcommands are given the arguments that follow their name, as in rosen users list -config server.json.
+var subcommands = map[string]func(args []string) error{
+	"users": users,
+	"ctl":   ctl,
+	"usage": showUsage,
+}
+
 func main() {
-	flag.BoolVar(&configure, "configure", false, "Specifies to run configuration client. All other flags are ignored.")
+	if len(os.Args) > 1 && subcommands[os.Args[1]] != nil {
+		if err := subcommands[os.Args[1]](os.Args[2:]); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	flag.BoolVar(&configure, "configure", false, "Specifies to run configuration client. Options not given as flags are asked for.")
+	configureOpts := config.RegisterFlags(flag.CommandLine)
 
 	flag.StringVar(&mode, "mode", "", strList(modes))
 	flag.StringVar(&configFile, "config", "", "Path to configuration file generated by -configure")
+	flag.StringVar(&importURI, "import", "", "Client configuration as a rosen:// URI, instead of -config.")
+	flag.BoolVar(&export, "export", false, "Print the client configuration for -config as a rosen:// URI and QR code.")
 
 	flag.IntVar(&socksPort, "socksPort", 23579, "Client-side port on which to start local SOCKS5 server.")
+	flag.StringVar(&logOpts.Level, "log-level", "info", "One of debug, info, warn, error")
+	flag.StringVar(&logOpts.Format, "log-format", "text", "One of text, json")
+	flag.BoolVar(&logOpts.Privacy, "log-privacy", false, "Redact destination and peer addresses, and the errors that may mention them, from logs.")
+	flag.StringVar(&metricsAddr, "metricsAddr", "", "Address on which to serve Prometheus metrics at /metrics, such as 127.0.0.1:9100. Disabled if empty.")
+	flag.StringVar(&controlPath, "control", "", "Path of a unix socket on which to serve the control API used by rosen ctl. Disabled if empty.")
+	flag.DurationVar(&drainTimeout, "drainTimeout", 10*time.Second, "How long to wait for open streams to be closed on both ends when shutting down.")
 
 	flag.Parse()
 
+	var err error
+	if logger, err = logging.New(os.Stderr, logOpts); err != nil {
+		help(err.Error())
+	}
+	slog.SetDefault(logger)
+
 	if configure {
-		filename, err := config.Configure()
-		if filename != "" {
-			fmt.Println("\nConfig file path:", filename)
+		result, err := config.Configure(configureOpts)
+		if result != nil && result.ServerFile != "" {
+			fmt.Println("\nServer config file path:", result.ServerFile)
+		}
+		if result != nil && result.ClientFile != "" {
+			fmt.Println("Client config file path:", result.ClientFile)
 		}
 		if err != nil {
 			fmt.Println("error:", err)
 			os.Exit(1)
 		}
+		if err := printShareable(result.Client); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	if configFile == "" {
+	if configFile == "" && importURI == "" {
 		help("configuration file must be specified")
 	}
 
+	var conf *config.Configuration
+	if importURI != "" {
+		conf, err = config.ParseURI(importURI)
+	} else {
+		conf, err = config.LoadConfig(configFile)
+	}
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	if export {
+		if err := printShareable(conf); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if mode == "" {
 		help("mode must be specified")
 	}
@@ -54,22 +130,86 @@ func main() {
 		help("invalid mode specified")
 	}
 
-	conf, err := config.LoadConfig(configFile)
-	if err != nil {
-		fmt.Println("error:", err)
+	if conf.Role != "" && conf.Role != mode {
+		fmt.Printf("error: this is a %s configuration and cannot be used in %s mode\n", conf.Role, mode)
 		os.Exit(1)
 	}
 
+	// The first SIGINT or SIGTERM starts a graceful shutdown, and a second one exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if metricsAddr != "" {
+		go serveMetrics(ctx, metricsAddr)
+	}
+
 	switch mode {
 	case "client":
-		if err := client(conf); err != nil {
-			fmt.Println("error:", err)
-		}
+		err = client(ctx, conf)
 	case "server":
-		if err := server(conf); err != nil {
-			fmt.Println("error:", err)
+		err = server(ctx, conf)
+	}
+	if err != nil {
+		logger.Error("exiting", logging.Err(err))
+		os.Exit(1)
+	}
+}
+
+// shutdown drains a client or server after ctx is cancelled, within drainTimeout.
+func shutdown(node interface {
+	Shutdown(context.Context) error
+}) error {
+	logger.Info("shutting down, closing open streams", "timeout", drainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := node.Shutdown(ctx); err != nil {
+		return fmt.Errorf("open streams were not drained within %s: %w", drainTimeout, err)
+	}
+	return nil
+}
+
+// serveMetrics serves the metrics at addr until ctx is cancelled.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logger.Info("serving metrics", "addr", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Error("metrics listener failed", logging.Err(err))
+	}
+}
+
+// serveControl serves the control API for node until ctx is cancelled, if a socket was given.
+func serveControl(ctx context.Context, node interface{}) {
+	inspector, ok := node.(router.Inspector)
+	if controlPath == "" || !ok {
+		return
+	}
+	go func() {
+		logger.Info("serving control API", "path", controlPath)
+		if err := control.ListenAndServe(ctx, controlPath, inspector); err != nil {
+			logger.Error("control API failed", logging.Err(err))
 		}
+	}()
+}
+
+// printShareable prints the client side of a configuration as a rosen:// URI and a QR code, for onboarding clients.
+func printShareable(conf *config.Configuration) error {
+	uri, err := conf.URI()
+	if err != nil {
+		return err
 	}
+	fmt.Println("\nClients can import this configuration with: rosen -mode client -import '" + uri + "'")
+	fmt.Println("Keep it secret, as it contains the key.")
+	qrterminal.GenerateHalfBlock(uri, qrterminal.L, os.Stdout)
+	return nil
 }
 
 func help(err string) {
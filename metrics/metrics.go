@@ -0,0 +1,352 @@
+// Package metrics implements counters, gauges and histograms that are exposed in the Prometheus text format.
+// Packages register their metrics with Default when they are initialised, and the metrics listener serves it.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry that the metrics of rosen are registered with.
+var Default = NewRegistry()
+
+// Registry holds a set of metrics.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes every metric in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mutex.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler returns a handler that serves the metrics to a Prometheus scraper.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// desc describes a metric and holds its series, one per combination of label values.
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mutex  sync.Mutex
+	series map[string]interface{} // joined label values => *Counter, *Gauge or *Histogram
+}
+
+func newDesc(name, help, kind string, labels []string) *desc {
+	return &desc{name: name, help: help, kind: kind, labels: labels, series: make(map[string]interface{})}
+}
+
+func (d *desc) with(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.name, len(d.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s, ok := d.series[key]
+	if !ok {
+		s = create()
+		d.series[key] = s
+	}
+	return s
+}
+
+// each calls f for every series in order of their label values.
+func (d *desc) each(f func(labels string, series interface{}) error) error {
+	d.mutex.Lock()
+	keys := make([]string, 0, len(d.series))
+	for key := range d.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]interface{}, len(keys))
+	for i, key := range keys {
+		series[i] = d.series[key]
+	}
+	d.mutex.Unlock()
+
+	for i, key := range keys {
+		var values []string
+		if len(d.labels) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+		if err := f(formatLabels(d.labels, values), series[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *desc) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.kind)
+	return err
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value uint64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec is a counter with a series per combination of label values.
+type CounterVec struct {
+	desc *desc
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newDesc(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// With returns the counter for the given label values.
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return c.desc.with(labelValues, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	if err := c.desc.writeHeader(w); err != nil {
+		return err
+	}
+	return c.desc.each(func(labels string, s interface{}) error {
+		_, err := fmt.Fprintf(w, "%s%s %d\n", c.desc.name, labels, s.(*Counter).Value())
+		return err
+	})
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	value int64
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.value, 1)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.value, -1)
+}
+
+// Set sets the gauge to n.
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.value, n)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// GaugeVec is a gauge with a series per combination of label values.
+type GaugeVec struct {
+	desc    *desc
+	collect func(set func(value int64, labelValues ...string))
+}
+
+// NewGauge registers a gauge with the given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{desc: newDesc(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose series are set by collect every time the metrics are read.
+// This suits values that are already tracked elsewhere, such as the length of a queue.
+func (r *Registry) NewGaugeFunc(name, help string, collect func(set func(value int64, labelValues ...string)), labels ...string) *GaugeVec {
+	g := &GaugeVec{desc: newDesc(name, help, "gauge", labels), collect: collect}
+	r.register(g)
+	return g
+}
+
+// With returns the gauge for the given label values.
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return g.desc.with(labelValues, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (g *GaugeVec) write(w io.Writer) error {
+	if g.collect != nil {
+		g.desc.mutex.Lock()
+		g.desc.series = make(map[string]interface{}) // series that are gone should not be reported
+		g.desc.mutex.Unlock()
+		g.collect(func(value int64, labelValues ...string) {
+			g.With(labelValues...).Set(value)
+		})
+	}
+	if err := g.desc.writeHeader(w); err != nil {
+		return err
+	}
+	return g.desc.each(func(labels string, s interface{}) error {
+		_, err := fmt.Fprintf(w, "%s%s %d\n", g.desc.name, labels, s.(*Gauge).Value())
+		return err
+	})
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+// Observe records a value.
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	i := sort.SearchFloat64s(h.buckets, value) // first bucket with an upper bound >= value
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// HistogramVec is a histogram with a series per combination of label values.
+type HistogramVec struct {
+	desc    *desc
+	buckets []float64
+}
+
+// DefaultBuckets suit latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewHistogram registers a histogram with the given upper bounds of its buckets, in increasing order, and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{desc: newDesc(name, help, "histogram", labels), buckets: buckets}
+	r.register(h)
+	return h
+}
+
+// With returns the histogram for the given label values.
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	return h.desc.with(labelValues, func() interface{} {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}).(*Histogram)
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	if err := h.desc.writeHeader(w); err != nil {
+		return err
+	}
+	return h.desc.each(func(labels string, s interface{}) error {
+		hist := s.(*Histogram)
+		hist.mutex.Lock()
+		counts := append([]uint64(nil), hist.counts...)
+		count, sum := hist.count, hist.sum
+		hist.mutex.Unlock()
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.desc.name, withLabel(labels, "le", formatFloat(bound)), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.desc.name, withLabel(labels, "le", "+Inf"), count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", h.desc.name, labels, formatFloat(sum)); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%s_count%s %d\n", h.desc.name, labels, count)
+		return err
+	})
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = names[i] + `="` + escapeLabel(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds a label to a formatted set of labels.
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + escapeLabel(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
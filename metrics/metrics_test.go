@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestTextFormat(t *testing.T) {
+	is := is.New(t)
+
+	r := NewRegistry()
+	requests := r.NewCounter("test_requests_total", "Requests handled.", "code")
+	requests.With("200").Add(3)
+	requests.With("500").Inc()
+	active := r.NewGauge("test_active", "Active things.")
+	active.With().Inc()
+	active.With().Inc()
+	active.With().Dec()
+	r.NewGaugeFunc("test_queue_length", "Queued items.", func(set func(int64, ...string)) {
+		set(7, `a"b`)
+	}, "queue")
+	latency := r.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	latency.With().Observe(0.05)
+	latency.With().Observe(0.5)
+	latency.With().Observe(5)
+
+	var buf bytes.Buffer
+	is.NoErr(r.Write(&buf))
+	is.Equal(buf.String(), `# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 3
+test_requests_total{code="500"} 1
+# HELP test_active Active things.
+# TYPE test_active gauge
+test_active 1
+# HELP test_queue_length Queued items.
+# TYPE test_queue_length gauge
+test_queue_length{queue="a\"b"} 7
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+`)
+}
@@ -0,0 +1,268 @@
+package https
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awnumar/rosen/config"
+
+	"lukechampine.com/frand"
+)
+
+// Requests are authenticated with a token derived from the key rather than the key itself, so that anyone
+// able to observe requests (for example a TLS-terminating CDN) cannot learn the key or replay what they see.
+//
+// token = base64url(timestamp || request ID || nonce || tag)
+// tag = HMAC-SHA256(k, method || " " || path || "\n" || SHA-256(body) || timestamp || request ID || nonce)
+//
+// The tag covers the path and body, so that a token cannot be moved to a request that carries other packets.
+// The request ID stays the same when a request is retried, which lets the server recognise retries,
+// while every attempt carries a fresh nonce and timestamp.
+
+const (
+	authTimestampSize = 8
+	authIDSize        = 16
+	authNonceSize     = 16
+	authTokenSize     = authTimestampSize + authIDSize + authNonceSize + sha256.Size
+
+	// Maximum difference between the client and server clocks.
+	authWindow = 2 * time.Minute
+
+	authKeyLabel = "rosen https request authentication"
+)
+
+var authLocations = map[string]string{ // location => default name
+	"cookie": "session",
+	"query":  "token",
+	"header": "Authorization",
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	requestBodyKey
+	requestUserKey
+)
+
+// authenticator signs requests with the first of its keys, and accepts requests signed with any of them.
+// On the server there is a key per user, and on the client just the one.
+type authenticator struct {
+	location string
+	name     string
+
+	mutex     sync.Mutex
+	keys      []config.UserKey     // derived from the user keys
+	seen      map[string]time.Time // nonce => expiry
+	lastPrune time.Time
+}
+
+func newAuthenticator(conf *config.Configuration) (*authenticator, error) {
+	keys, err := deriveKeys(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	location := conf.HTTPS.AuthLocation
+	if location == "" {
+		location = "cookie"
+	}
+	defaultName, ok := authLocations[location]
+	if !ok {
+		return nil, errors.New("unknown authLocation: " + location)
+	}
+	name := conf.HTTPS.AuthName
+	if name == "" {
+		name = defaultName
+	}
+
+	return &authenticator{
+		keys:     keys,
+		location: location,
+		name:     name,
+		seen:     make(map[string]time.Time),
+	}, nil
+}
+
+func deriveKeys(conf *config.Configuration) ([]config.UserKey, error) {
+	users, err := conf.UserKeys()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]config.UserKey, len(users))
+	for i, user := range users {
+		mac := hmac.New(sha256.New, user.Key)
+		mac.Write([]byte(authKeyLabel))
+		keys[i] = config.UserKey{Name: user.Name, Key: mac.Sum(nil)}
+	}
+	return keys, nil
+}
+
+// setUsers replaces the keys that are accepted, keeping track of the tokens that have already been seen.
+// It returns the users whose key is no longer accepted.
+func (a *authenticator) setUsers(conf *config.Configuration) ([]string, error) {
+	keys, err := deriveKeys(conf)
+	if err != nil {
+		return nil, err
+	}
+	a.mutex.Lock()
+	revoked := config.RevokedUsers(a.keys, keys)
+	a.keys = keys
+	a.mutex.Unlock()
+	return revoked, nil
+}
+
+func (a *authenticator) currentKeys() []config.UserKey {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.keys
+}
+
+// sign attaches a fresh token to the request, replacing any from a previous attempt.
+// The request ID and body are taken from the request context.
+func (a *authenticator) sign(r *http.Request) {
+	id, _ := r.Context().Value(requestIDKey).([]byte)
+	body, _ := r.Context().Value(requestBodyKey).([]byte)
+	bodyHash := sha256.Sum256(body)
+
+	token := make([]byte, authTimestampSize, authTokenSize)
+	binary.BigEndian.PutUint64(token, uint64(time.Now().Unix()))
+	token = append(token, id...)
+	token = append(token, frand.Bytes(authNonceSize)...)
+	token = append(token, mac(a.currentKeys()[0].Key, r, bodyHash[:], token)...)
+	encoded := base64.RawURLEncoding.EncodeToString(token)
+
+	switch a.location {
+	case "cookie":
+		r.Header.Set("Cookie", (&http.Cookie{Name: a.name, Value: encoded}).String())
+	case "query":
+		query := r.URL.Query()
+		query.Set(a.name, encoded)
+		r.URL.RawQuery = query.Encode()
+	case "header":
+		if strings.EqualFold(a.name, "Authorization") {
+			encoded = "Bearer " + encoded
+		}
+		r.Header.Set(a.name, encoded)
+	}
+}
+
+// verify checks the token attached to a request and returns the user whose key it was signed with and the request ID it carries.
+// Tokens with a stale timestamp or that have been seen before are rejected. The body of requests with a well-formed token
+// is read to check it against the MAC, and replaced so that it can be read again. Bodies larger than any that a client
+// sends are rejected without reading them in full, as anyone can make a well-formed token.
+func (a *authenticator) verify(w http.ResponseWriter, r *http.Request) (user string, id []byte, ok bool) {
+	var encoded string
+	switch a.location {
+	case "cookie":
+		if cookie, err := r.Cookie(a.name); err == nil {
+			encoded = cookie.Value
+		}
+	case "query":
+		encoded = r.URL.Query().Get(a.name)
+	case "header":
+		encoded = strings.TrimPrefix(r.Header.Get(a.name), "Bearer ")
+	}
+
+	token, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(token) != authTokenSize {
+		return "", nil, false
+	}
+	signed, tag := token[:authTokenSize-sha256.Size], token[authTokenSize-sha256.Size:]
+
+	timestamp := time.Unix(int64(binary.BigEndian.Uint64(signed)), 0)
+	if time.Since(timestamp) > authWindow || time.Until(timestamp) > authWindow {
+		return "", nil, false
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return "", nil, false
+		}
+	}
+	bodyHash := sha256.Sum256(body)
+
+	for _, key := range a.currentKeys() {
+		if hmac.Equal(tag, mac(key.Key, r, bodyHash[:], signed)) {
+			user = key.Name
+			break
+		}
+	}
+	if user == "" {
+		return "", nil, false
+	}
+
+	nonce := string(signed[authTimestampSize+authIDSize:])
+	now := time.Now()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if now.Sub(a.lastPrune) > time.Second {
+		for n, expiry := range a.seen {
+			if now.After(expiry) {
+				delete(a.seen, n)
+			}
+		}
+		a.lastPrune = now
+	}
+	if _, replayed := a.seen[nonce]; replayed {
+		return "", nil, false
+	}
+	a.seen[nonce] = timestamp.Add(authWindow) // after which the timestamp check rejects it anyway
+
+	return user, signed[authTimestampSize : authTimestampSize+authIDSize], true
+}
+
+func mac(key []byte, r *http.Request, bodyHash, signed []byte) []byte {
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/" // as the request is sent
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(r.Method + " " + path + "\n"))
+	mac.Write(bodyHash)
+	mac.Write(signed)
+	return mac.Sum(nil)
+}
+
+// withRequestID attaches the ID of a request to its context. On the client this is the ID to sign with,
+// and on the server the ID that the request was authenticated with.
+func withRequestID(r *http.Request, id []byte) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+}
+
+// withRequestBody attaches the body of a request to its context, for the client to sign.
+func withRequestBody(r *http.Request, body []byte) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestBodyKey, body))
+}
+
+// withUser attaches the name of the user that a request was authenticated as to its context.
+func withUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestUserKey, user))
+}
+
+// RequestUser returns the name of the user that an authenticated request was made by.
+func RequestUser(r *http.Request) string {
+	user, _ := r.Context().Value(requestUserKey).(string)
+	return user
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).([]byte)
+	return base64.RawStdEncoding.EncodeToString(id)
+}
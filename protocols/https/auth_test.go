@@ -0,0 +1,155 @@
+package https
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"lukechampine.com/frand"
+
+	"github.com/awnumar/rosen/config"
+)
+
+func TestAuthenticator(t *testing.T) {
+	is := is.New(t)
+
+	for _, location := range []string{"cookie", "query", "header"} {
+		conf := &config.Configuration{
+			AuthToken: base64.RawStdEncoding.EncodeToString(frand.Bytes(32)),
+			HTTPS: &config.HTTPSConfig{
+				AuthLocation: location,
+			},
+		}
+		client, err := newAuthenticator(conf)
+		is.NoErr(err)
+		server, err := newAuthenticator(conf)
+		is.NoErr(err)
+
+		id := frand.Bytes(authIDSize)
+		req, err := http.NewRequest(http.MethodPost, "https://example.com/", nil)
+		is.NoErr(err)
+		req = withRequestID(req, id)
+
+		client.sign(req)
+		user, verifiedID, ok := server.verify(httptest.NewRecorder(), req)
+		is.True(ok)
+		is.Equal(user, config.DefaultUser)
+		is.True(bytes.Equal(id, verifiedID))
+
+		_, _, ok = server.verify(httptest.NewRecorder(), req)
+		is.True(!ok) // replay
+
+		client.sign(req)
+		_, verifiedID, ok = server.verify(httptest.NewRecorder(), req)
+		is.True(ok) // retry with a fresh token
+		is.True(bytes.Equal(id, verifiedID))
+
+		client.sign(req)
+		req.Method = http.MethodGet
+		_, _, ok = server.verify(httptest.NewRecorder(), req)
+		is.True(!ok) // method is covered by the MAC
+
+		conf.AuthToken = base64.RawStdEncoding.EncodeToString(frand.Bytes(32))
+		other, err := newAuthenticator(conf)
+		is.NoErr(err)
+		req.Method = http.MethodPost
+		other.sign(req)
+		_, _, ok = server.verify(httptest.NewRecorder(), req)
+		is.True(!ok) // wrong key
+
+		payload := []byte(`[{"id":"a"}]`)
+		req, err = http.NewRequest(http.MethodPost, "https://example.com/", bytes.NewReader(payload))
+		is.NoErr(err)
+		req = withRequestBody(withRequestID(req, id), payload)
+		client.sign(req)
+		req.Body = ioutil.NopCloser(strings.NewReader(`[{"id":"b"}]`))
+		_, _, ok = server.verify(httptest.NewRecorder(), req)
+		is.True(!ok) // body is covered by the MAC
+
+		client.sign(req)
+		req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		req.URL.Path = "/other"
+		_, _, ok = server.verify(httptest.NewRecorder(), req)
+		is.True(!ok) // path is covered by the MAC
+
+		req.URL.Path = "/"
+		client.sign(req)
+		req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		_, _, ok = server.verify(httptest.NewRecorder(), req)
+		is.True(ok)
+		body, err := ioutil.ReadAll(req.Body)
+		is.NoErr(err)
+		is.Equal(body, payload) // still there for the handler
+
+		large := &countingReader{}
+		req.Body = ioutil.NopCloser(large)
+		client.sign(req)
+		_, _, ok = server.verify(httptest.NewRecorder(), req)
+		is.True(!ok)
+		is.True(large.n <= maxRequestSize+1) // not read in full
+	}
+}
+
+// countingReader is an endless body that counts the bytes read from it.
+type countingReader struct {
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.n += len(p)
+	return len(p), nil
+}
+
+func TestAuthenticatorUsers(t *testing.T) {
+	is := is.New(t)
+
+	conf := &config.Configuration{
+		Role:      "server",
+		AuthToken: base64.RawStdEncoding.EncodeToString(frand.Bytes(32)),
+		HTTPS:     &config.HTTPSConfig{},
+	}
+	_, err := conf.AddUser("alice")
+	is.NoErr(err)
+	_, err = conf.AddUser("bob")
+	is.NoErr(err)
+	server, err := newAuthenticator(conf)
+	is.NoErr(err)
+
+	for _, u := range conf.Users {
+		client, err := newAuthenticator(&config.Configuration{
+			AuthToken: u.Key,
+			HTTPS:     &config.HTTPSConfig{},
+		})
+		is.NoErr(err)
+
+		req, err := http.NewRequest(http.MethodPost, "https://example.com/", nil)
+		is.NoErr(err)
+		req = withRequestID(req, frand.Bytes(authIDSize))
+		client.sign(req)
+
+		user, _, ok := server.verify(httptest.NewRecorder(), req)
+		is.True(ok)
+		is.Equal(user, u.Name)
+	}
+
+	bob, err := newAuthenticator(&config.Configuration{
+		AuthToken: conf.Users[1].Key,
+		HTTPS:     &config.HTTPSConfig{},
+	})
+	is.NoErr(err)
+	is.NoErr(conf.RemoveUser("bob"))
+	server, err = newAuthenticator(conf)
+	is.NoErr(err)
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com/", nil)
+	is.NoErr(err)
+	req = withRequestID(req, frand.Bytes(authIDSize))
+	bob.sign(req)
+	_, _, ok := server.verify(httptest.NewRecorder(), req)
+	is.True(!ok) // revoked
+}
@@ -1,47 +1,64 @@
 package https
 
 import (
-	"fmt"
-	"io/ioutil"
-	"net/http"
+	"log/slog"
+
+	"github.com/awnumar/rosen/logging"
+	"github.com/awnumar/rosen/metrics"
+	"github.com/awnumar/rosen/router"
 )
 
 const (
 	clientBufferSize = 4096
 	serverBufferSize = 4096
-)
 
-func getResponseText(resp *http.Response) (string, error) {
-	respBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	resp.Body.Close()
-	return string(respBytes), nil
-}
+	// Largest body of a request from a client: a full buffer of packets, whose data JSON encodes in base64, with room
+	// for their IDs and destinations.
+	maxRequestSize = clientBufferSize * (router.MaxDataSize*4/3 + 1024)
+)
 
-// custom logger for http client
+var (
+	requestDuration = metrics.Default.NewHistogram("rosen_https_request_duration_seconds",
+		"Time taken by the client to exchange packets with the server, including retries.", metrics.DefaultBuckets)
+	requestRetries = metrics.Default.NewCounter("rosen_https_retries_total", "Requests that the client had to send again.")
+)
 
-type logger struct{}
+// leveledLogger adapts a slog.Logger to the logger interface of the http client. The URL that the client logs is the
+// address of the server, and is logged as the peer so that it is redacted in privacy mode, as are errors.
+type leveledLogger struct {
+	logger *slog.Logger
+}
 
-func (l logger) Error(msg string, keysAndValues ...interface{}) {
-	output(msg, keysAndValues...)
+func (l leveledLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.logger.Error(msg, attrs(keysAndValues)...)
 }
 
-func (l logger) Info(msg string, keysAndValues ...interface{}) {
-	output(msg, keysAndValues...)
+func (l leveledLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.logger.Info(msg, attrs(keysAndValues)...)
 }
 
-func (l logger) Debug(msg string, keysAndValues ...interface{}) {}
+func (l leveledLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.logger.Debug(msg, attrs(keysAndValues)...)
+}
 
-func (l logger) Warn(msg string, keysAndValues ...interface{}) {
-	output(msg, keysAndValues...)
+func (l leveledLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.logger.Warn(msg, attrs(keysAndValues)...)
 }
 
-func output(msg string, keysAndValues ...interface{}) {
-	fmt.Print(msg, " ")
-	for _, kv := range keysAndValues {
-		fmt.Print(kv, " ")
+// attrs renames the keys that the http client logs the server and errors under.
+func attrs(keysAndValues []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(keysAndValues))
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		key, value := keysAndValues[i], keysAndValues[i+1]
+		switch key {
+		case "url":
+			key = logging.PeerKey
+		case "request": // the method and URL
+			continue
+		case "error":
+			key = logging.ErrKey
+		}
+		out = append(out, key, value)
 	}
-	fmt.Println("")
+	return out
 }
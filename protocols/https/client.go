@@ -2,34 +2,77 @@ package https
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/awnumar/rosen/config"
 	"github.com/awnumar/rosen/crypto"
+	"github.com/awnumar/rosen/logging"
 	"github.com/awnumar/rosen/router"
 
 	"github.com/hashicorp/go-retryablehttp"
 	"lukechampine.com/frand"
 )
 
+const (
+	// Number of consecutive failed exchanges after which the session is considered lost.
+	failureThreshold = 5
+
+	minBackoff = 250 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
 // Client implements a HTTPS tunnel client.
 type Client struct {
-	authToken string
-	remote    string
-	client    *retryablehttp.RoundTripper
-	router    *router.Router
+	auth   *authenticator
+	remote string
+	client *retryablehttp.RoundTripper
+	router *router.Router
+	logger *slog.Logger
+
+	stop    chan struct{} // closed to ask run to return once the outbound queue is empty
+	stopped chan struct{} // closed by run when it returns
+
+	stateMutex   sync.Mutex
+	state        router.State
+	stateChanges chan router.StateChange
+}
+
+// StatusError is returned when the server responds to a request with an unexpected status.
+type StatusError struct {
+	Status string
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return "server returned " + e.Status + ": " + e.Body
+}
+
+// DecodeError is returned when a response cannot be parsed.
+// This usually means that the request was answered by the decoy, because the key is wrong.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return "failed to parse JSON response (is the authentication key correct?): " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
 }
 
 // NewClient returns a new HTTPS client.
-func NewClient(conf config.Configuration) (*Client, error) {
-	trustPool, err := crypto.TrustedCertPool(conf["pinRootCA"])
+func NewClient(conf *config.Configuration, logger *slog.Logger) (*Client, error) {
+	tlsConfig, err := clientTLSConfig(conf.HTTPS)
 	if err != nil {
 		return nil, err
 	}
@@ -37,91 +80,244 @@ func NewClient(conf config.Configuration) (*Client, error) {
 	client := retryablehttp.NewClient()
 	client.HTTPClient = &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: trustPool,
-			},
+			TLSClientConfig: tlsConfig,
 		},
 	}
-	client.Logger = logger{}
+	client.RetryMax = 2 // longer outages are handled by the backoff in run
+	client.Logger = leveledLogger{logger}
+
+	auth, err := newAuthenticator(conf)
+	if err != nil {
+		return nil, err
+	}
+	client.RequestLogHook = func(_ retryablehttp.Logger, req *http.Request, attempt int) {
+		auth.sign(req) // every attempt needs a fresh token
+		if attempt > 0 {
+			requestRetries.With().Inc()
+		}
+	}
 
 	c := &Client{
-		authToken: conf["authToken"],
-		remote:    conf["proxyAddr"],
+		auth:   auth,
+		remote: conf.HTTPS.ProxyAddr,
 		client: &retryablehttp.RoundTripper{
 			Client: client,
 		},
-		router: router.NewRouter(),
+		router:       router.NewRouter(router.WithLogger(logger), router.WithName(router.ClientSession), router.WithPriorities(conf.PortWeight)),
+		logger:       logger,
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+		state:        router.Connecting,
+		stateChanges: make(chan router.StateChange, 16),
 	}
 
-	go func(c *Client) {
-		outboundBuffer := make([]router.Packet, clientBufferSize)
+	go c.run()
 
-		for {
-			size := c.router.Fill(outboundBuffer)
+	return c, nil
+}
+
+// run exchanges packets with the server until it is stopped by Shutdown.
+// A request that fails is retried with the same ID and payload, so that the server can tell it apart from a new one.
+// After failureThreshold consecutive failures the session is considered lost and all streams are reset.
+func (c *Client) run() {
+	outboundBuffer := make([]router.Packet, clientBufferSize)
 
-			responseData := c.do(outboundBuffer[:size])
+	var (
+		pending  []byte // payload of the request in flight, if any
+		size     int    // number of packets in pending
+		id       []byte
+		failures int
+	)
 
-			go c.router.Ingest(responseData)
+	defer close(c.stopped)
 
-			if size > 0 || c.router.QueueLen() > 0 || len(responseData) > 0 {
-				continue // skip delay
+	for {
+		select {
+		case <-c.stop:
+			if size == 0 && c.router.QueueLen() == 0 {
+				return // nothing left to deliver
 			}
+		default:
+		}
 
-			time.Sleep(time.Duration(frand.Intn(100_000_000)) * time.Nanosecond)
+		if pending == nil {
+			size = c.router.Fill(outboundBuffer)
+			payload, err := json.Marshal(outboundBuffer[:size])
+			router.Recycle(outboundBuffer[:size])
+			if err != nil {
+				c.logger.Error("failed to encode message payload", logging.Err(err))
+				continue
+			}
+			pending, id = payload, frand.Bytes(authIDSize)
 		}
-	}(c)
 
-	return c, nil
+		responseData, err := c.do(id, pending)
+		if err != nil {
+			failures++
+			switch {
+			case failures == failureThreshold:
+				c.router.Reset()
+				pending, size = nil, 0
+				c.setState(router.Failed, err)
+			case failures < failureThreshold && c.State() == router.Connected:
+				c.setState(router.Degraded, err)
+			}
+			time.Sleep(backoff(failures))
+			continue
+		}
+
+		pending = nil
+		failures = 0
+		sent := size
+		size = 0
+		c.setState(router.Connected, nil)
+
+		c.router.Ingest(responseData) // in order, before the next response
+
+		if sent > 0 || c.router.QueueLen() > 0 || len(responseData) > 0 {
+			continue // skip delay
+		}
+
+		time.Sleep(time.Duration(frand.Intn(100_000_000)) * time.Nanosecond)
+	}
 }
 
-func (c *Client) do(data []router.Packet) (responseData []router.Packet) {
-	id := base64.RawStdEncoding.EncodeToString(frand.Bytes(16))
+// backoff returns an exponentially increasing, jittered delay for the given number of consecutive failures.
+func backoff(failures int) time.Duration {
+	delay := maxBackoff
+	if failures < 16 {
+		if d := minBackoff << (failures - 1); d < maxBackoff {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(frand.Intn(int(delay/2)))
+}
 
-	payload, err := json.Marshal(data)
+// State returns the current state of the session with the server.
+func (c *Client) State() router.State {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.state
+}
+
+// StateChanges returns a channel on which changes to the state of the session are reported.
+// Changes are dropped if the channel is not being read from.
+func (c *Client) StateChanges() <-chan router.StateChange {
+	return c.stateChanges
+}
+
+func (c *Client) setState(state router.State, err error) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	if c.state == state {
+		return
+	}
+	if state == router.Connected || state == router.Degraded {
+		router.TunnelsActive.With("https").Set(1)
+	} else {
+		router.TunnelsActive.With("https").Set(0)
+	}
+	c.state = state
+	select {
+	case c.stateChanges <- router.StateChange{State: state, Err: err}:
+	default:
+	}
+}
+
+// clientTLSConfig returns the TLS configuration used to verify the server, depending on where it gets its certificate from.
+func clientTLSConfig(conf *config.HTTPSConfig) (*tls.Config, error) {
+	if conf.CAFingerprint != "" {
+		remote, err := url.Parse(conf.ProxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			InsecureSkipVerify:    true, // the chain is verified against the pinned CA instead of the system roots
+			VerifyPeerCertificate: crypto.VerifyPinnedCA(conf.CAFingerprint, remote.Hostname()),
+		}, nil
+	}
+
+	// the LetsEncrypt roots are only relevant to ACME certificates
+	trustPool, err := crypto.TrustedCertPool(conf.PinRootCA && conf.CertSource == "acme")
 	if err != nil {
-		panic("error: failed to encode message payload: " + err.Error())
+		return nil, err
 	}
+	return &tls.Config{
+		RootCAs: trustPool,
+	}, nil
+}
 
+func (c *Client) do(id, payload []byte) ([]router.Packet, error) {
 	req, err := http.NewRequest(http.MethodPost, c.remote, bytes.NewReader(payload))
 	if err != nil {
-		panic("error: failed to create request object: " + err.Error())
+		return nil, err
 	}
+	req = withRequestBody(withRequestID(req, id), payload)
 
-	req.Header.Set("ID", id)
-	req.Header.Set("Auth-Token", c.authToken)
+	start := time.Now()
+	defer func() {
+		requestDuration.With().Observe(time.Since(start).Seconds())
+	}()
 
-retry:
 	resp, err := c.client.RoundTrip(req) // retries on connection error or 5XX response
 	if err != nil {
-		errorString := "error: " + err.Error()
-		if resp != nil {
-			errorString += "\nstatus: " + resp.Status
-			if r, err := getResponseText(resp); err == nil {
-				errorString += "\nresponse: " + r
-			}
-		}
-		panic(errorString)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	respBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Println("error while reading server response: " + err.Error())
-		goto retry
+		return nil, err
 	}
-	resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		panic("error: server returned " + resp.Status + "\n" + string(respBytes))
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Status: resp.Status, Body: string(respBytes)}
 	}
 
+	var responseData []router.Packet
 	if err := json.Unmarshal(respBytes, &responseData); err != nil {
-		panic("error: failed to parse JSON response (is the authentication code correct?)\nerror: " + err.Error())
+		return nil, &DecodeError{Err: err}
 	}
 
-	return
+	return responseData, nil
 }
 
 // HandleConnection handles and proxies a single connection between a local client and the remote server.
 func (c *Client) HandleConnection(dest router.Endpoint, conn net.Conn) error {
 	return c.router.HandleConnection(dest, conn)
 }
+
+// Shutdown closes the open streams and returns once the server has been told about them, or when ctx is done.
+func (c *Client) Shutdown(ctx context.Context) error {
+	err := c.router.Shutdown(ctx)
+	close(c.stop)
+	select {
+	case <-c.stopped:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return err
+}
+
+// Sessions returns the session with the server.
+func (c *Client) Sessions() []router.SessionInfo {
+	return []router.SessionInfo{{
+		Name:    router.ClientSession,
+		State:   c.State().String(),
+		Streams: c.router.Streams(),
+	}}
+}
+
+// CloseSession closes every stream.
+func (c *Client) CloseSession(name string) bool {
+	if name != router.ClientSession {
+		return false
+	}
+	c.router.Reset()
+	return true
+}
+
+// CloseStream closes a single stream.
+func (c *Client) CloseStream(id string) bool {
+	return c.router.CloseStream(id)
+}
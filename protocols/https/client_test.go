@@ -0,0 +1,90 @@
+package https
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/router"
+
+	"github.com/matryer/is"
+	"lukechampine.com/frand"
+)
+
+func waitState(is *is.I, c *Client, state router.State) {
+	is.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case change := <-c.StateChanges():
+			if change.State == state {
+				return
+			}
+		case <-timeout:
+			is.Fail() // state was not reached
+		}
+	}
+}
+
+func TestClientStates(t *testing.T) {
+	is := is.New(t)
+
+	var failing, requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			http.NotFound(w, r) // not retried by the http client, unlike server errors
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	c, err := NewClient(&config.Configuration{
+		AuthToken: base64.RawStdEncoding.EncodeToString(frand.Bytes(32)),
+		HTTPS:     &config.HTTPSConfig{ProxyAddr: server.URL},
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	is.NoErr(err)
+	defer c.Shutdown(context.Background())
+
+	waitState(is, c, router.Connected)
+
+	atomic.StoreInt32(&failing, 1)
+	waitState(is, c, router.Degraded)
+	is.Equal(c.State(), router.Degraded)
+	waitState(is, c, router.Failed) // after failureThreshold failures
+
+	before := atomic.LoadInt32(&requests)
+	atomic.StoreInt32(&failing, 0)
+	waitState(is, c, router.Connected) // the client keeps trying
+	is.True(atomic.LoadInt32(&requests) > before)
+}
+
+func TestBackoff(t *testing.T) {
+	is := is.New(t)
+
+	previous := time.Duration(0)
+	for failures := 1; failures <= 100; failures++ {
+		ceiling := maxBackoff
+		if failures < 16 && minBackoff<<(failures-1) < maxBackoff {
+			ceiling = minBackoff << (failures - 1)
+		}
+		for i := 0; i < 20; i++ {
+			d := backoff(failures)
+			is.True(d >= ceiling/2) // jittered down by at most half
+			is.True(d < ceiling)
+			is.True(d <= maxBackoff)
+		}
+		is.True(ceiling >= previous) // never shorter after more failures
+		previous = ceiling
+	}
+	is.True(backoff(1) < minBackoff)
+	is.True(backoff(1000) >= maxBackoff/2)
+}
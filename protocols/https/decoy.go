@@ -0,0 +1,49 @@
+package https
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/awnumar/rosen/config"
+)
+
+// DecoyHandler returns the handler for unauthenticated visitors selected by the decoy config value.
+func DecoyHandler(conf *config.HTTPSConfig) (http.HandlerFunc, error) {
+	switch conf.Decoy {
+	case "", "static":
+		return StaticHandler.ServeHTTP, nil
+	case "proxy":
+		upstream, err := url.Parse(conf.DecoyUpstream)
+		if err != nil {
+			return nil, err
+		}
+		return ReverseProxyHandler(upstream), nil
+	case "dir":
+		return DirectoryHandler(conf.DecoyDir), nil
+	default:
+		return nil, errors.New("unknown decoy: " + conf.Decoy)
+	}
+}
+
+// ReverseProxyHandler returns a decoy that passes requests through to an upstream website,
+// so that the server is indistinguishable from that website to anyone without a key.
+func ReverseProxyHandler(upstream *url.URL) http.HandlerFunc {
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = upstream.Host            // upstream may be using virtual hosting
+		r.Header["X-Forwarded-For"] = nil // don't advertise that the request was proxied
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy.ServeHTTP
+}
+
+// DirectoryHandler returns a decoy that serves the contents of a local directory.
+func DirectoryHandler(dir string) http.HandlerFunc {
+	return http.FileServer(http.Dir(dir)).ServeHTTP
+}
@@ -0,0 +1,165 @@
+package https
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol support, so that the real client address is known when running behind a load balancer.
+// Both the text (v1) and binary (v2) headers are accepted.
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+const proxyProtoHeaderTimeout = 10 * time.Second
+
+var (
+	proxyProtoV1Prefix  = []byte("PROXY ")
+	proxyProtoSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func newProxyProtoListener(l net.Listener) net.Listener {
+	return &proxyProtoListener{l}
+}
+
+// Accept returns connections without reading the header, so that a slow client cannot block the accept loop.
+// The header is parsed on first use of the connection.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout))
+		c.remoteAddr, c.err = readProxyProtoHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtoHeader consumes a PROXY protocol header and returns the source address it carries.
+// A nil address is returned for headers that do not describe a proxied connection, such as health checks.
+func readProxyProtoHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoSignature))
+	if err == nil && bytes.Equal(sig, proxyProtoSignature) {
+		return readProxyProtoV2(r)
+	}
+	prefix, err := r.Peek(len(proxyProtoV1Prefix))
+	if err == nil && bytes.Equal(prefix, proxyProtoV1Prefix) {
+		return readProxyProtoV1(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, errors.New("error: connection did not start with a PROXY protocol header")
+}
+
+func readProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	const maxLength = 107 // including CRLF, as defined by the spec
+
+	var line []byte
+	for len(line) < maxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("error: invalid PROXY protocol v1 header")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("error: invalid PROXY protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("error: invalid address in PROXY protocol v1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("error: unsupported PROXY protocol version")
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if header[12]&0xF == 0 {
+		return nil, nil // LOCAL command, sent by the proxy itself
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("error: truncated PROXY protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("error: truncated PROXY protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil // unspecified or unsupported family; fall back to the socket address
+	}
+}
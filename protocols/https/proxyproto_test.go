@@ -0,0 +1,58 @@
+package https
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestProxyProtoV1(t *testing.T) {
+	is := is.New(t)
+
+	r := bufio.NewReader(bytes.NewReader([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n")))
+	addr, err := readProxyProtoHeader(r)
+	is.NoErr(err)
+	is.Equal(addr.String(), "192.0.2.1:56324")
+
+	rest, err := io.ReadAll(r)
+	is.NoErr(err)
+	is.Equal(string(rest), "GET / HTTP/1.1\r\n") // header should be consumed exactly
+
+	r = bufio.NewReader(bytes.NewReader([]byte("PROXY UNKNOWN\r\n")))
+	addr, err = readProxyProtoHeader(r)
+	is.NoErr(err)
+	is.Equal(addr, nil)
+
+	r = bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n")))
+	_, err = readProxyProtoHeader(r)
+	is.True(err != nil) // header is required
+}
+
+func TestProxyProtoV2(t *testing.T) {
+	is := is.New(t)
+
+	addresses := make([]byte, 36)
+	copy(addresses[0:16], net.ParseIP("2001:db8::1"))
+	copy(addresses[16:32], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(addresses[32:34], 40000)
+	binary.BigEndian.PutUint16(addresses[34:36], 443)
+
+	header := append([]byte{}, proxyProtoSignature...)
+	header = append(header, 0x21, 0x21, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addresses)))
+	header = append(header, addresses...)
+
+	r := bufio.NewReader(bytes.NewReader(append(header, "payload"...)))
+	addr, err := readProxyProtoHeader(r)
+	is.NoErr(err)
+	is.Equal(addr.String(), "[2001:db8::1]:40000")
+
+	rest, err := io.ReadAll(r)
+	is.NoErr(err)
+	is.Equal(string(rest), "payload")
+}
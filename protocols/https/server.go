@@ -2,47 +2,70 @@ package https
 
 import (
 	"context"
-	"crypto/subtle"
 	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"errors"
 	"io/fs"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/awnumar/rosen/config"
 	"github.com/awnumar/rosen/crypto"
+	"github.com/awnumar/rosen/limits"
+	"github.com/awnumar/rosen/logging"
 	"github.com/awnumar/rosen/router"
 )
 
 // Server implements a HTTP tunnel server.
 type Server struct {
-	conf          config.Configuration
+	started       *config.Configuration
+	conf          *config.HTTPSConfig
 	tlsConfig     *tls.Config
 	redirect      *http.Server
 	server        *http.Server
+	auth          *authenticator
 	cmd           chan string
 	cmdDone       chan struct{}
-	router        *router.Router
-	buffer        []router.Packet
-	previous      chan *response
+	sessions      sync.Map // user name => *session
+	closing       int32    // set atomically once new streams are refused
 	authenticated http.HandlerFunc
+	mutex         sync.RWMutex // guards decoy
 	decoy         http.HandlerFunc
+	customDecoy   bool
+	limits        *limits.Limits
+	opts          []router.Option // for the router of every user
+	logger        *slog.Logger
+}
+
+// reloadable lists the values that Reload applies to a running server.
+var reloadable = []string{"authToken", "users", "limits", "priorities", "https.decoy", "https.decoyUpstream", "https.decoyDir"}
+
+// session holds the state of the tunnel of a single user.
+type session struct {
+	router   *router.Router
+	buffer   []router.Packet
+	previous chan *response
 }
 
 type response struct {
-	reqID    string
-	respData []router.Packet
+	reqID   string
+	payload []byte
 }
 
 var s = &Server{}
 
-// NewServer returns a new HTTPS server.
-func NewServer(conf config.Configuration) (*Server, error) {
+// NewServer returns a new HTTPS server. opts are applied to the router of every user, after the options that follow
+// from the configuration.
+func NewServer(conf *config.Configuration, logger *slog.Logger, opts ...router.Option) (*Server, error) {
 	var tlsMaxVersion uint16
-	switch conf["tlsMaxVersion"] {
+	switch conf.HTTPS.TLSMaxVersion {
 	case "1.2":
 		tlsMaxVersion = tls.VersionTLS12
 	case "1.3":
@@ -51,31 +74,69 @@ func NewServer(conf config.Configuration) (*Server, error) {
 		return nil, errors.New("tlsMaxversion must be one of 1.2 or 1.3")
 	}
 
+	auth, err := newAuthenticator(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	decoy, err := DecoyHandler(conf.HTTPS)
+	if err != nil {
+		return nil, err
+	}
+
+	serverLimits, err := limits.New(conf)
+	if err != nil {
+		return nil, err
+	}
+
 	s = &Server{
-		conf: conf,
+		started: conf,
+		conf:    conf.HTTPS,
 		tlsConfig: &tls.Config{
 			MinVersion: tls.VersionTLS12,
 			MaxVersion: tlsMaxVersion,
 		},
+		auth:          auth,
 		cmd:           make(chan string),
 		cmdDone:       make(chan struct{}),
-		router:        router.NewRouter(),
-		buffer:        make([]router.Packet, serverBufferSize),
-		previous:      make(chan *response, 1),
 		authenticated: ProxyHandler,
-		decoy:         StaticHandler.ServeHTTP,
-	}
-
-	s.previous <- &response{
-		reqID:    "",
-		respData: []router.Packet{},
+		decoy:         decoy,
+		limits:        serverLimits,
+		opts:          opts,
+		logger:        logger,
 	}
 
 	return s, nil
 }
 
-func NewServerWithCustomHandlers(conf config.Configuration, authenticated http.HandlerFunc, decoy http.HandlerFunc) (*Server, error) {
-	s, err := NewServer(conf)
+// session returns the session of a user, creating it on their first request.
+func (s *Server) session(user string) *session {
+	if existing, ok := s.sessions.Load(user); ok {
+		return existing.(*session)
+	}
+	opts := append(s.limits.Options(user), router.WithLogger(s.logger.With(logging.User(user))), router.WithName(user))
+	sess := &session{
+		router:   router.NewRouter(append(opts, s.opts...)...),
+		buffer:   make([]router.Packet, serverBufferSize),
+		previous: make(chan *response, 1),
+	}
+	sess.previous <- &response{
+		reqID:   "",
+		payload: []byte("[]"),
+	}
+	existing, loaded := s.sessions.LoadOrStore(user, sess)
+	if !loaded {
+		s.logger.Info("user connected", logging.User(user))
+		router.TunnelsActive.With("https").Inc()
+		if atomic.LoadInt32(&s.closing) == 1 {
+			sess.router.Close()
+		}
+	}
+	return existing.(*session)
+}
+
+func NewServerWithCustomHandlers(conf *config.Configuration, logger *slog.Logger, authenticated http.HandlerFunc, decoy http.HandlerFunc) (*Server, error) {
+	s, err := NewServer(conf, logger)
 	if err != nil {
 		return s, err
 	}
@@ -85,57 +146,80 @@ func NewServerWithCustomHandlers(conf config.Configuration, authenticated http.H
 	}
 	if decoy != nil {
 		s.decoy = decoy
+		s.customDecoy = true
 	}
 
 	return s, nil
 }
 
-// Start launches the server.
-func (s *Server) Start() error {
-	certReloader, err := crypto.GetCertificate(
-		s.conf["hostname"],
-		s.conf["email"],
-		func() {
-			s.cmd <- "stop"
-			<-s.cmdDone
-		}, func() {
-			s.cmd <- "start"
-			<-s.cmdDone
-		}, func(err error) {
-			panic(err)
-		}, func() { s.cmd <- "end" })
+// Reload replaces the users, limits, priorities and decoy of the server. The sessions of users that
+// were removed or whose key changed are closed.
+func (s *Server) Reload(conf *config.Configuration) ([]string, error) {
+	if conf.HTTPS == nil {
+		return nil, errors.New("cannot change the protocol of a running server")
+	}
+	if !s.customDecoy {
+		decoy, err := DecoyHandler(conf.HTTPS)
+		if err != nil {
+			return nil, err
+		}
+		s.mutex.Lock()
+		s.decoy = decoy
+		s.mutex.Unlock()
+	}
+	revoked, err := s.auth.setUsers(conf)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for _, user := range revoked {
+		if _, ok := s.sessions.Load(user); ok {
+			s.logger.Info("closing session of revoked user", logging.User(user))
+			s.endSession(user)
+		}
+	}
+	s.limits.Update(conf)
+	return config.RestartRequired(s.started, conf, reloadable), nil
+}
+
+// Start launches the server. Once ctx is cancelled new streams are refused, but requests are still served
+// so that clients can collect what is left of the open streams until Shutdown.
+func (s *Server) Start(ctx context.Context) error {
+	if !s.conf.PlainHTTP {
+		if err := s.loadCertificate(); err != nil {
+			return err
+		}
 	}
-	s.tlsConfig.GetCertificate = certReloader.GetCertificateFunc()
 
-	httpError := make(chan error)
-	httpsError := make(chan error)
-	defer close(httpError)
-	defer close(httpsError)
+	// buffered, as the listeners may still be running when Start returns
+	httpError := make(chan error, 1)
+	httpsError := make(chan error, 1)
 
 	start := func() struct{} {
-		s.redirect = &http.Server{
-			Addr: ":80",
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				http.Redirect(w, r, "https://"+r.Host+r.RequestURI, http.StatusMovedPermanently)
-			}),
+		if !s.conf.PlainHTTP && s.conf.RedirectAddr != "none" {
+			s.redirect = &http.Server{
+				Addr:     s.conf.RedirectAddr,
+				Handler:  http.HandlerFunc(s.redirectHandler),
+				ErrorLog: slog.NewLogLogger(s.logger.Handler(), slog.LevelDebug),
+			}
+			go func() {
+				httpError <- s.redirect.ListenAndServe()
+			}()
 		}
 		s.server = &http.Server{
-			Addr:      ":443",
 			Handler:   http.HandlerFunc(handler),
 			TLSConfig: s.tlsConfig,
+			ErrorLog:  slog.NewLogLogger(s.logger.Handler(), slog.LevelDebug), // mostly failed TLS handshakes from scanners
 		}
 		go func() {
-			httpError <- s.redirect.ListenAndServe()
-		}()
-		go func() {
-			httpsError <- s.server.ListenAndServeTLS("", "")
+			httpsError <- s.listenAndServe(s.server)
 		}()
 		return struct{}{}
 	}
 
 	shutdown := func(serv *http.Server) {
+		if serv == nil {
+			return
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*time.Second)
 		serv.Shutdown(ctx)
 		cancel()
@@ -148,10 +232,18 @@ func (s *Server) Start() error {
 	}
 
 	start()
+	go s.limits.KeepUsage(ctx, s.logger)
 
 	cmdShutdown := false
 	for {
 		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&s.closing, 1)
+			s.sessions.Range(func(_, sess interface{}) bool {
+				sess.(*session).router.Close()
+				return true
+			})
+			return nil
 		case err := <-httpError:
 			if !cmdShutdown {
 				shutdown(s.server)
@@ -181,23 +273,159 @@ func (s *Server) Start() error {
 	}
 }
 
-// Compare key with execution time that is a function of input length and not of input contents.
-// Average time Delta between a valid and invalid key length is 29ns, on a Ryzen 3700X.
-func (s *Server) authenticate(provided string) bool {
-	authToken := s.conf["authToken"]
+// Shutdown closes the streams of every user, waits until clients have collected them, and stops the listeners.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.closing, 1)
+
+	var err error
+	s.sessions.Range(func(_, sess interface{}) bool {
+		if shutdownErr := sess.(*session).router.Shutdown(ctx); shutdownErr != nil {
+			err = shutdownErr
+		}
+		return true
+	})
+
+	for _, serv := range []*http.Server{s.server, s.redirect} {
+		if serv == nil {
+			continue
+		}
+		if shutdownErr := serv.Shutdown(ctx); shutdownErr != nil {
+			serv.Close()
+			err = shutdownErr
+		}
+	}
+	if saveErr := s.limits.SaveUsage(); saveErr != nil {
+		err = saveErr
+	}
+	return err
+}
+
+// Sessions returns the sessions of the users that have made requests since the server started.
+// There is no connection to speak of, so every session is reported as connected.
+func (s *Server) Sessions() []router.SessionInfo {
+	sessions := []router.SessionInfo{}
+	s.sessions.Range(func(user, sess interface{}) bool {
+		sessions = append(sessions, router.SessionInfo{
+			Name:    user.(string),
+			State:   router.Connected.String(),
+			Streams: sess.(*session).router.Streams(),
+		})
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Name < sessions[j].Name
+	})
+	return sessions
+}
 
-	if len(provided) != len(authToken) {
+// CloseSession closes the streams of a user. The client is told about them on its next request.
+func (s *Server) CloseSession(user string) bool {
+	sess, ok := s.sessions.Load(user)
+	if !ok {
 		return false
 	}
+	sess.(*session).router.Reset()
+	return true
+}
 
-	equal := true
-	for i := 0; i < len(authToken); i++ {
-		if subtle.ConstantTimeByteEq(provided[i], authToken[i]) != 1 {
-			equal = false
-		}
+// endSession closes the streams of a user and forgets their session, so that a new one is started if they make
+// another request.
+func (s *Server) endSession(user string) {
+	sess, ok := s.sessions.LoadAndDelete(user)
+	if !ok {
+		return
+	}
+	sess.(*session).router.Reset()
+	sess.(*session).router.Close()
+	router.TunnelsActive.With("https").Dec()
+	s.logger.Info("user disconnected", logging.User(user))
+}
+
+// CloseStream closes a stream of any user.
+func (s *Server) CloseStream(id string) (closed bool) {
+	s.sessions.Range(func(_, sess interface{}) bool {
+		closed = sess.(*session).router.CloseStream(id)
+		return !closed
+	})
+	return closed
+}
+
+// listenAndServe listens on the configured address and serves either TLS or, behind a TLS-terminating proxy, plain HTTP.
+func (s *Server) listenAndServe(serv *http.Server) error {
+	listener, err := net.Listen("tcp", s.conf.ListenAddr)
+	if err != nil {
+		return err
+	}
+	if s.conf.ProxyProtocol {
+		listener = newProxyProtoListener(listener)
+	}
+	if s.conf.PlainHTTP {
+		return serv.Serve(listener)
+	}
+	return serv.ServeTLS(listener, "", "")
+}
+
+// redirectHandler sends plain HTTP visitors to the same URL on the HTTPS listener.
+func (s *Server) redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host // no port in request
+	}
+	if _, port, err := net.SplitHostPort(s.conf.ListenAddr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
 	}
+	http.Redirect(w, r, "https://"+host+r.RequestURI, http.StatusMovedPermanently)
+}
 
-	return equal
+// loadCertificate configures where the server's TLS certificate comes from, according to the certSource config value.
+func (s *Server) loadCertificate() error {
+	switch s.conf.CertSource {
+	case "files":
+		cert, err := crypto.NewFileCertificate(s.conf.CertFile, s.conf.KeyFile)
+		if err != nil {
+			return err
+		}
+		s.tlsConfig.GetCertificate = cert.GetCertificate
+	case "selfsigned":
+		ca, err := crypto.LoadOrCreateCA(s.conf.CADir)
+		if err != nil {
+			return err
+		}
+		if ca.Fingerprint() != s.conf.CAFingerprint {
+			s.logger.Warn("CA fingerprint does not match config; clients must pin it", "fingerprint", ca.Fingerprint())
+		}
+		cert, err := ca.NewIssuedCertificate(s.conf.Hostname)
+		if err != nil {
+			return err
+		}
+		s.tlsConfig.GetCertificate = cert.GetCertificate
+	default:
+		// ACME: the certificate is renewed in the background, and the listeners have to be
+		// stopped while that happens since the challenge is served on the same ports.
+		httpAddr := s.conf.RedirectAddr
+		if httpAddr == "none" {
+			httpAddr = ":80"
+		}
+		certReloader, err := crypto.GetCertificate(
+			s.conf.Hostname,
+			s.conf.Email,
+			httpAddr,
+			s.conf.ListenAddr,
+			func() {
+				s.cmd <- "stop"
+				<-s.cmdDone
+			}, func() {
+				s.cmd <- "start"
+				<-s.cmdDone
+			}, func(err error) {
+				panic(err)
+			}, func() { s.cmd <- "end" })
+		if err != nil {
+			return err
+		}
+		s.tlsConfig.GetCertificate = certReloader.GetCertificateFunc()
+	}
+	return nil
 }
 
 //go:embed static/*
@@ -212,10 +440,14 @@ var StaticHandler = func() http.Handler {
 
 // authenticate request
 func handler(w http.ResponseWriter, r *http.Request) {
-	if s.authenticate(r.Header.Get("Auth-Token")) {
-		s.authenticated(w, r) // authenticated proxy handler
+	if user, id, ok := s.auth.verify(w, r); ok {
+		s.authenticated(w, withUser(withRequestID(r, id), user)) // authenticated proxy handler
 	} else {
-		s.decoy(w, r) // decoy handler
+		router.AuthFailures.With("https").Inc()
+		s.mutex.RLock()
+		decoy := s.decoy
+		s.mutex.RUnlock()
+		decoy(w, r) // decoy handler
 	}
 }
 
@@ -225,11 +457,8 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id := r.Header.Get("ID")
-	if id == "" {
-		http.Error(w, "error: ID header must be included", http.StatusBadRequest)
-		return
-	}
+	id := requestID(r)
+	sess := s.session(RequestUser(r))
 
 	reqBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -244,22 +473,28 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	prev := <-s.previous
+	prev := <-sess.previous
 
 	if id != prev.reqID { // previous request was successful
-		go s.router.Ingest(packets)
-
+		// Ingested while the session is held, as the packets of consecutive requests must be passed on in order.
+		// Ingest does not wait on the streams, so this does not hold up the response.
+		sess.router.Ingest(packets)
+
+		// The payload is kept in case the client retries the request, so the buffer can be reused straight away.
+		respData := sess.buffer[:sess.router.Fill(sess.buffer)]
+		payload, err := json.Marshal(respData)
+		router.Recycle(respData)
+		if err != nil {
+			sess.previous <- prev
+			http.Error(w, "error: failed to marshal return payload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 		prev.reqID = id
-		prev.respData = s.buffer[:s.router.Fill(s.buffer)]
+		prev.payload = payload
 	}
 
-	s.previous <- prev
-
-	payload, err := json.Marshal(prev.respData)
-	if err != nil {
-		http.Error(w, "error: failed to marshal return payload: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	payload := prev.payload
+	sess.previous <- prev
 
 	if _, err := w.Write(payload); err != nil {
 		http.Error(w, "error: failed to write response: "+err.Error(), http.StatusInternalServerError)
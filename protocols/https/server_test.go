@@ -0,0 +1,127 @@
+package https
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/router"
+
+	"github.com/matryer/is"
+	"lukechampine.com/frand"
+)
+
+// dialerFunc adapts a function to router.Dialer.
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+func testConfig() *config.Configuration {
+	return &config.Configuration{
+		Role:      "server",
+		Protocol:  "https",
+		AuthToken: base64.RawStdEncoding.EncodeToString(frand.Bytes(32)),
+		HTTPS:     &config.HTTPSConfig{TLSMaxVersion: "1.3"},
+	}
+}
+
+func testServer(is *is.I, conf *config.Configuration, opts ...router.Option) *Server {
+	srv, err := NewServer(conf, slog.New(slog.NewTextHandler(io.Discard, nil)), opts...)
+	is.NoErr(err)
+	return srv
+}
+
+// post passes packets to the server as an authenticated request of user would, and returns the answer.
+func post(is *is.I, user string, packets []router.Packet) []router.Packet {
+	body, err := json.Marshal(packets)
+	is.NoErr(err)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	ProxyHandler(w, withUser(withRequestID(req, frand.Bytes(authIDSize)), user))
+	is.Equal(w.Code, http.StatusOK)
+	var answer []router.Packet
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &answer))
+	return answer
+}
+
+// TestServerOrder checks that the data of a stream is written in the order of the requests that carried it.
+func TestServerOrder(t *testing.T) {
+	is := is.New(t)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	testServer(is, testConfig(), router.WithDialer(dialerFunc(func(context.Context, string, string) (net.Conn, error) {
+		return local, nil
+	})))
+
+	const requests = 500
+	received := make(chan []byte, 1)
+	go func() {
+		data := make([]byte, requests)
+		io.ReadFull(remote, data)
+		received <- data
+	}()
+
+	post(is, config.DefaultUser, []router.Packet{router.NewPacket("y", router.NewEndpoint("tcp", "example.com:80"))})
+	sent := make([]byte, requests)
+	for i := range sent {
+		sent[i] = byte(i)
+		post(is, config.DefaultUser, []router.Packet{router.DataPacket("y", sent[i:i+1])})
+	}
+	select {
+	case data := <-received:
+		is.Equal(data, sent)
+	case <-time.After(5 * time.Second):
+		is.Fail() // data was lost
+	}
+}
+
+// TestServerRevoke checks that reloading a configuration without a user, or with a new key for them, closes their
+// session.
+func TestServerRevoke(t *testing.T) {
+	is := is.New(t)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conf := testConfig()
+	_, err := conf.AddUser("alice")
+	is.NoErr(err)
+	srv := testServer(is, conf, router.WithDialer(dialerFunc(func(context.Context, string, string) (net.Conn, error) {
+		return local, nil
+	})))
+
+	post(is, "alice", []router.Packet{router.NewPacket("y", router.NewEndpoint("tcp", "example.com:80"))})
+	post(is, config.DefaultUser, nil)
+	is.Equal(len(srv.Sessions()), 2)
+	tunnels := router.TunnelsActive.With("https").Value()
+
+	reloaded := *conf
+	is.NoErr(reloaded.RemoveUser("alice"))
+	_, err = srv.Reload(&reloaded)
+	is.NoErr(err)
+	sessions := srv.Sessions()
+	is.Equal(len(sessions), 1)
+	is.Equal(sessions[0].Name, config.DefaultUser)
+	is.Equal(router.TunnelsActive.With("https").Value(), tunnels-1) // the tunnel of alice is no longer counted
+
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = remote.Read(make([]byte, 1))
+	is.True(err == io.EOF) // the stream of alice was closed
+
+	rotated := reloaded
+	rotated.AuthToken = base64.RawStdEncoding.EncodeToString(frand.Bytes(32))
+	_, err = srv.Reload(&rotated)
+	is.NoErr(err)
+	is.Equal(len(srv.Sessions()), 0) // the key of the default user changed
+}
@@ -1,58 +1,125 @@
 package tcp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
-	"strconv"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/limits"
+	"github.com/awnumar/rosen/logging"
 	"github.com/awnumar/rosen/router"
 	"github.com/awnumar/rosen/tunnel"
 )
 
+// Server implements a TCP tunnel server. Every user has a router of their own, shared by all of their connections
+// through a tunnel group.
 type Server struct {
-	router *router.Router
-	key    []byte
-	port   int
+	conf    *config.Configuration // as started with
+	users   []config.UserKey
+	closing bool
+	mutex   sync.RWMutex // guards users and closing
+	routers sync.Map     // user name => *router.Router
+	groups  sync.Map     // user name => *tunnel.Group, driving the router of the user
+	created sync.Mutex   // held while creating a router and its group
+	conns   sync.Map     // *net.TCPConn => user name, the tunnels from clients; empty until the client is authenticated
+	port    int
+	limits  *limits.Limits
+	opts    []router.Option // for the router of every user
+	logger  *slog.Logger
 }
 
+// reloadable lists the values that Reload applies to a running server.
+var reloadable = []string{"authToken", "users", "limits", "priorities"}
+
 type Client struct {
-	router     *router.Router
-	key        []byte
-	remoteAddr *net.TCPAddr
-	remoteConn *net.TCPConn
+	router      *router.Router
+	key         []byte
+	remoteAddr  *net.TCPAddr
+	remoteConn  *net.TCPConn   // the latest connection to the server, which is dialled again whenever it fails
+	tunnel      *tunnel.Tunnel // through remoteConn, once it is up
+	tunnelMutex sync.Mutex     // guards remoteConn and tunnel
+
+	// With more than one tunnel, the router is driven by a group, and tunnels that fail are dialled again. remoteConn
+	// is then unused.
+	group *tunnel.Group
+	stop  chan struct{} // closed by Shutdown
+
+	stateMutex   sync.Mutex
+	state        router.State
+	stateChanges chan router.StateChange
 }
 
-func NewServer(conf config.Configuration) (*Server, error) {
-	key, err := config.DecodeKeyString(conf["authToken"])
+const (
+	// How long a client waits before dialling a failed tunnel again, doubling up to the maximum while it keeps failing.
+	minRedialDelay = time.Second
+	maxRedialDelay = 30 * time.Second
+
+	// A tunnel that stayed up for this long resets the delay.
+	stableTunnel = time.Minute
+
+	// Number of times in a row that a tunnel of a group can fail to come up, while the group has none, before the
+	// session is considered lost. The client keeps dialling.
+	failureThreshold = 5
+)
+
+// NewServer returns a new TCP server. opts are applied to the router of every user, after the options that follow from
+// the configuration.
+func NewServer(conf *config.Configuration, logger *slog.Logger, opts ...router.Option) (*Server, error) {
+	users, err := conf.UserKeys()
 	if err != nil {
 		return nil, err
 	}
-	port, err := strconv.Atoi(conf["serverPort"])
+	serverLimits, err := limits.New(conf)
 	if err != nil {
 		return nil, err
 	}
 	return &Server{
-		router: router.NewRouter(),
-		key:    key,
-		port:   port,
+		conf:   conf,
+		users:  users,
+		port:   conf.TCP.ServerPort,
+		limits: serverLimits,
+		opts:   opts,
+		logger: logger,
 	}, nil
 }
 
-func NewClient(conf config.Configuration) (*Client, error) {
-	key, err := config.DecodeKeyString(conf["authToken"])
+// Reload replaces the users, limits and priorities of the server. The sessions of users that were removed or whose
+// key changed are closed.
+func (s *Server) Reload(conf *config.Configuration) ([]string, error) {
+	users, err := conf.UserKeys()
 	if err != nil {
 		return nil, err
 	}
+	s.mutex.Lock()
+	revoked := config.RevokedUsers(s.users, users)
+	s.users = users
+	s.mutex.Unlock()
+	for _, user := range revoked {
+		if _, ok := s.routers.Load(user); ok {
+			s.logger.Info("closing session of revoked user", logging.User(user))
+			s.CloseSession(user)
+		}
+	}
+	s.limits.Update(conf)
+	return config.RestartRequired(s.conf, conf, reloadable), nil
+}
 
-	port, err := strconv.Atoi(conf["serverPort"])
+func NewClient(conf *config.Configuration, logger *slog.Logger) (*Client, error) {
+	key, err := config.DecodeKeyString(conf.AuthToken)
 	if err != nil {
 		return nil, err
 	}
 
 	var serverAddrs []net.IP
-	serverAddr := conf["serverAddr"]
+	serverAddr := conf.TCP.ServerAddr
 	if !govalidator.IsIP(serverAddr) {
 		// assume serverAddr is a DNS name
 		ips, err := net.LookupIP(serverAddr)
@@ -66,35 +133,175 @@ func NewClient(conf config.Configuration) (*Client, error) {
 
 	remoteAddr := &net.TCPAddr{
 		IP:   serverAddrs[0],
-		Port: port,
+		Port: conf.TCP.ServerPort,
 	}
 
-	r := router.NewRouter()
+	r := router.NewRouter(router.WithLogger(logger), router.WithName(router.ClientSession), router.WithPriorities(conf.PortWeight))
+
+	if conf.TCP.Tunnels > 1 {
+		c := &Client{
+			router:       r,
+			key:          key,
+			remoteAddr:   remoteAddr,
+			stop:         make(chan struct{}),
+			state:        router.Connecting,
+			stateChanges: make(chan router.StateChange, 16),
+		}
+		c.group = tunnel.NewGroup(r, tunnel.WithTunnelsChanged(func(tunnels int) {
+			if tunnels > 0 {
+				c.setState(router.Connected, nil)
+				return
+			}
+			select {
+			case <-c.stop:
+			default:
+				if c.State() == router.Connected {
+					c.setState(router.Degraded, nil)
+				}
+			}
+		}))
+		for i := 0; i < conf.TCP.Tunnels; i++ {
+			go c.keepTunnel(tunnel.WithKeepalive(conf.KeepaliveTimes()), logger)
+		}
+		return c, nil
+	}
 
 	conn, err := net.DialTCP("tcp", nil, remoteAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	go func(conn *net.TCPConn) {
-		tunnel, err := tunnel.New(conn, key)
-		if err != nil {
-			// todo: redial and retry; handle
-			fmt.Println("error creating tunnel:", err)
-		}
-		fmt.Println("exiting tunnel.proxywithrouter:", tunnel.ProxyWithRouter(r))
-		// todo: redial and retry
-	}(conn)
-
-	return &Client{
-		router:     r,
-		key:        key,
-		remoteAddr: remoteAddr,
-		remoteConn: conn,
-	}, nil
+	c := &Client{
+		router:       r,
+		key:          key,
+		remoteAddr:   remoteAddr,
+		remoteConn:   conn,
+		stop:         make(chan struct{}),
+		state:        router.Connecting,
+		stateChanges: make(chan router.StateChange, 16),
+	}
+
+	go c.keepSingleTunnel(conn, tunnel.WithKeepalive(conf.KeepaliveTimes()), logger)
+
+	return c, nil
+}
+
+// keepTunnel keeps a tunnel of the group up, dialling it again whenever it fails, until the client is shut down.
+func (c *Client) keepTunnel(keepalive tunnel.Option, logger *slog.Logger) {
+	delay := minRedialDelay
+	failures := 0
+	for {
+		started := time.Now()
+		err := c.addTunnel(keepalive)
+		if err == tunnel.ErrNoGroups {
+			logger.Error("server does not support several tunnels; set tunnels to 1 or upgrade the server", logging.Err(err))
+			c.setState(router.Failed, err)
+			return
+		}
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		if time.Since(started) > stableTunnel {
+			delay, failures = minRedialDelay, 0
+		}
+		if failures++; failures >= failureThreshold && c.group.Tunnels() == 0 {
+			c.setState(router.Failed, err)
+		}
+		logger.Warn("tunnel closed, dialling again", logging.Err(err), slog.Duration("delay", delay))
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRedialDelay {
+			delay = maxRedialDelay
+		}
+	}
+}
+
+// keepSingleTunnel proxies through a tunnel over conn and, whenever the tunnel fails, closes the streams that went
+// through it and dials the server again, until the client is shut down.
+func (c *Client) keepSingleTunnel(conn *net.TCPConn, keepalive tunnel.Option, logger *slog.Logger) {
+	delay := minRedialDelay
+	for {
+		started := time.Now()
+		err := c.proxy(conn, keepalive)
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		c.router.Reset() // the server closes the streams of a tunnel that fails
+		c.setState(router.Failed, err)
+		if time.Since(started) > stableTunnel {
+			delay = minRedialDelay
+		}
+
+		for {
+			logger.Warn("tunnel closed, dialling again", logging.Err(err), slog.Duration("delay", delay))
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxRedialDelay {
+				delay = maxRedialDelay
+			}
+			if conn, err = net.DialTCP("tcp", nil, c.remoteAddr); err == nil {
+				break
+			}
+		}
+	}
 }
 
-func (s *Server) Start() error {
+// proxy sets up a tunnel over conn and proxies through it until it fails, or until the client is shut down.
+func (c *Client) proxy(conn *net.TCPConn, keepalive tunnel.Option) error {
+	c.tunnelMutex.Lock()
+	select {
+	case <-c.stop:
+		c.tunnelMutex.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	c.remoteConn = conn
+	c.tunnelMutex.Unlock()
+	defer conn.Close()
+
+	t, err := tunnel.New(conn, c.key, keepalive)
+	if err != nil {
+		return err
+	}
+	c.tunnelMutex.Lock()
+	c.tunnel = t
+	c.tunnelMutex.Unlock()
+
+	c.setState(router.Connected, nil)
+	router.TunnelsActive.With("tcp").Inc()
+	defer router.TunnelsActive.With("tcp").Dec()
+	return t.ProxyWithRouter(c.router)
+}
+
+// addTunnel dials a tunnel and adds it to the group. It returns once the tunnel has failed.
+func (c *Client) addTunnel(keepalive tunnel.Option) error {
+	conn, err := net.DialTCP("tcp", nil, c.remoteAddr)
+	if err != nil {
+		return err
+	}
+	t, err := tunnel.New(conn, c.key, keepalive)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	router.TunnelsActive.With("tcp").Inc()
+	defer router.TunnelsActive.With("tcp").Dec()
+	return c.group.Add(t, c.remoteAddr.String())
+}
+
+// Start accepts tunnels from clients until ctx is cancelled.
+func (s *Server) Start(ctx context.Context) error {
 	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
 		IP:   net.ParseIP("0.0.0.0"),
 		Port: s.port,
@@ -102,25 +309,256 @@ func (s *Server) Start() error {
 	if err != nil {
 		return err
 	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go s.limits.KeepUsage(ctx, s.logger)
 
 	for {
 		conn, err := listener.AcceptTCP()
 		if err != nil {
-			fmt.Println("error while accepting connection:", err)
+			if ctx.Err() != nil {
+				s.close()
+				return nil
+			}
+			s.logger.Warn("failed to accept connection", logging.Err(err))
+			continue
 		}
 
 		go func(conn *net.TCPConn) {
-			tunnel, err := tunnel.New(conn, s.key)
+			s.conns.Store(conn, "")
+			defer s.conns.Delete(conn)
+
+			s.mutex.RLock()
+			users := s.users
+			s.mutex.RUnlock()
+
+			keys := make([][]byte, len(users))
+			for i := range users {
+				keys[i] = users[i].Key
+			}
+			tun, index, err := tunnel.Accept(conn, keys, tunnel.WithKeepalive(s.conf.KeepaliveTimes()))
+			if err == tunnel.ErrUnknownKey {
+				router.AuthFailures.With("tcp").Inc()
+			}
+			if errors.Is(err, io.EOF) {
+				// closed without sending anything, as the checks of clients with several servers are
+				s.logger.Debug("connection closed before authenticating", logging.Peer(conn.RemoteAddr().String()))
+				conn.Close()
+				return
+			}
 			if err != nil {
-				fmt.Println(err)
+				s.logger.Info("rejected connection", logging.Peer(conn.RemoteAddr().String()), logging.Err(err))
+				conn.Close()
 				return
 			}
+			user := users[index].Name
+			s.conns.Store(conn, user)
 
-			fmt.Println(tunnel.ProxyWithRouter(s.router))
+			s.logger.Info("user connected", logging.User(user), logging.Peer(conn.RemoteAddr().String()))
+			router.TunnelsActive.With("tcp").Inc()
+			err = s.group(user).Serve(tun)
+			conn.Close()
+			router.TunnelsActive.With("tcp").Dec()
+			s.logger.Info("user disconnected", logging.User(user), logging.Peer(conn.RemoteAddr().String()), logging.Err(err))
 		}(conn)
 	}
 }
 
+// close stops every router from accepting new streams.
+func (s *Server) close() {
+	s.mutex.Lock()
+	s.closing = true
+	s.mutex.Unlock()
+	s.routers.Range(func(_, r interface{}) bool {
+		r.(*router.Router).Close()
+		return true
+	})
+}
+
+// Shutdown closes the streams of every user and, once they have been drained and sent, the tunnels.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.close()
+
+	var err error
+	s.routers.Range(func(_, r interface{}) bool {
+		if shutdownErr := r.(*router.Router).Shutdown(ctx); shutdownErr != nil {
+			err = shutdownErr
+		}
+		return true
+	})
+	s.groups.Range(func(_, g interface{}) bool {
+		if flushErr := g.(*tunnel.Group).Flush(ctx); flushErr != nil {
+			err = flushErr
+		}
+		return true
+	})
+	s.conns.Range(func(conn, _ interface{}) bool {
+		conn.(*net.TCPConn).Close()
+		return true
+	})
+	if saveErr := s.limits.SaveUsage(); saveErr != nil {
+		err = saveErr
+	}
+	return err
+}
+
+// group returns the tunnel group of a user, creating it and the router of the user on first use.
+func (s *Server) group(user string) *tunnel.Group {
+	if g, ok := s.groups.Load(user); ok {
+		return g.(*tunnel.Group)
+	}
+	s.created.Lock()
+	defer s.created.Unlock()
+	if g, ok := s.groups.Load(user); ok {
+		return g.(*tunnel.Group)
+	}
+	opts := append(s.limits.Options(user), router.WithLogger(s.logger.With(logging.User(user))), router.WithName(user))
+	r := router.NewRouter(append(opts, s.opts...)...)
+	s.mutex.RLock()
+	if s.closing {
+		r.Close()
+	}
+	s.mutex.RUnlock()
+	g := tunnel.NewGroup(r)
+	s.routers.Store(user, r)
+	s.groups.Store(user, g)
+	return g
+}
+
+// Sessions returns the routers of the users that have connected since the server started.
+func (s *Server) Sessions() []router.SessionInfo {
+	connected := make(map[string]bool)
+	s.conns.Range(func(_, user interface{}) bool {
+		connected[user.(string)] = true
+		return true
+	})
+
+	sessions := []router.SessionInfo{}
+	s.routers.Range(func(user, r interface{}) bool {
+		state := "disconnected"
+		if connected[user.(string)] {
+			state = router.Connected.String()
+		}
+		sessions = append(sessions, router.SessionInfo{
+			Name:    user.(string),
+			State:   state,
+			Streams: r.(*router.Router).Streams(),
+		})
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Name < sessions[j].Name
+	})
+	return sessions
+}
+
+// CloseSession closes the streams of a user and drops their tunnels. They are free to connect again.
+func (s *Server) CloseSession(user string) bool {
+	r, ok := s.routers.Load(user)
+	if !ok {
+		return false
+	}
+	r.(*router.Router).Reset()
+	s.conns.Range(func(conn, name interface{}) bool {
+		if name.(string) == user {
+			conn.(*net.TCPConn).Close()
+		}
+		return true
+	})
+	return true
+}
+
+// CloseStream closes a stream of any user.
+func (s *Server) CloseStream(id string) (closed bool) {
+	s.routers.Range(func(_, r interface{}) bool {
+		closed = r.(*router.Router).CloseStream(id)
+		return !closed
+	})
+	return closed
+}
+
 func (c *Client) HandleConnection(dest router.Endpoint, conn net.Conn) error {
 	return c.router.HandleConnection(dest, conn)
 }
+
+// Shutdown closes the open streams and, once the server has been told about them, the tunnel.
+func (c *Client) Shutdown(ctx context.Context) error {
+	err := c.router.Shutdown(ctx)
+	if err == nil {
+		err = c.flush(ctx)
+	}
+	close(c.stop)
+	if c.group != nil {
+		c.group.Close()
+		return err
+	}
+	c.tunnelMutex.Lock()
+	c.remoteConn.Close()
+	c.tunnelMutex.Unlock()
+	return err
+}
+
+// flush waits until the packets that the router has handed over to the tunnels have been sent.
+func (c *Client) flush(ctx context.Context) error {
+	if c.group != nil {
+		return c.group.Flush(ctx)
+	}
+	c.tunnelMutex.Lock()
+	t := c.tunnel
+	c.tunnelMutex.Unlock()
+	if t == nil {
+		return nil // never connected
+	}
+	return t.Flush(ctx, c.router)
+}
+
+// Sessions returns the session with the server.
+func (c *Client) Sessions() []router.SessionInfo {
+	return []router.SessionInfo{{
+		Name:    router.ClientSession,
+		State:   c.State().String(),
+		Streams: c.router.Streams(),
+	}}
+}
+
+// State returns the current state of the session with the server.
+func (c *Client) State() router.State {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.state
+}
+
+// StateChanges returns a channel on which changes to the state of the session are reported.
+// Changes are dropped if the channel is not being read from.
+func (c *Client) StateChanges() <-chan router.StateChange {
+	return c.stateChanges
+}
+
+func (c *Client) setState(state router.State, err error) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	if c.state == state {
+		return
+	}
+	c.state = state
+	select {
+	case c.stateChanges <- router.StateChange{State: state, Err: err}:
+	default:
+	}
+}
+
+// CloseSession closes every stream. The tunnel is kept up.
+func (c *Client) CloseSession(name string) bool {
+	if name != router.ClientSession {
+		return false
+	}
+	c.router.Reset()
+	return true
+}
+
+// CloseStream closes a single stream.
+func (c *Client) CloseStream(id string) bool {
+	return c.router.CloseStream(id)
+}
@@ -0,0 +1,248 @@
+package tcp
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/router"
+
+	"github.com/matryer/is"
+	"lukechampine.com/frand"
+)
+
+// TestChain opens a stream through a chain of servers on localhost, each of which opens the streams of its users
+// through the next.
+func TestChain(t *testing.T) {
+	is := is.New(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// The servers are started from the last hop back, as each needs the next to be up to connect to it.
+	const hops = 3
+	servers := make([]*Server, hops)
+	var next *config.Configuration // client configuration for the server started last
+	for i := hops - 1; i >= 0; i-- {
+		conf := &config.Configuration{
+			Role:      "server",
+			Protocol:  "tcp",
+			AuthToken: base64.RawStdEncoding.EncodeToString(frand.Bytes(32)),
+			TCP:       &config.TCPConfig{ServerAddr: "127.0.0.1", ServerPort: freePort(is)},
+		}
+		var opts []router.Option
+		if next != nil {
+			upstream, err := NewClient(next, logger)
+			is.NoErr(err)
+			defer upstream.Shutdown(context.Background())
+			opts = append(opts, router.WithDialer(router.Through(upstream)))
+		}
+		servers[i], err = NewServer(conf, logger, opts...)
+		is.NoErr(err)
+		go servers[i].Start(ctx)
+		waitListening(is, conf.TCP.ServerPort)
+
+		next = &config.Configuration{Role: "client", Protocol: "tcp", AuthToken: conf.AuthToken, TCP: conf.TCP}
+	}
+
+	client, err := NewClient(next, logger)
+	is.NoErr(err)
+	defer client.Shutdown(context.Background())
+
+	local, remote := net.Pipe()
+	is.NoErr(client.HandleConnection(router.NewEndpoint("tcp", echo.Addr().String()), remote))
+	message := frand.Bytes(100 * 1024)
+	go local.Write(message)
+	received := make([]byte, len(message))
+	_, err = io.ReadFull(local, received)
+	is.NoErr(err)
+	is.Equal(received, message)
+
+	for _, s := range servers {
+		sessions := s.Sessions()
+		is.Equal(len(sessions), 1)
+		is.Equal(len(sessions[0].Streams), 1) // every hop carries the stream
+	}
+	local.Close()
+}
+
+// TestRevoke checks that reloading a configuration with a new key for a user closes their session.
+func TestRevoke(t *testing.T) {
+	is := is.New(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	conf := &config.Configuration{
+		Role:      "server",
+		Protocol:  "tcp",
+		AuthToken: base64.RawStdEncoding.EncodeToString(frand.Bytes(32)),
+		TCP:       &config.TCPConfig{ServerAddr: "127.0.0.1", ServerPort: freePort(is)},
+	}
+	alice, err := conf.AddUser("alice")
+	is.NoErr(err)
+	server, err := NewServer(conf, logger)
+	is.NoErr(err)
+	go server.Start(ctx)
+	waitListening(is, conf.TCP.ServerPort)
+
+	client, err := NewClient(&config.Configuration{Role: "client", Protocol: "tcp", AuthToken: alice.Key, TCP: conf.TCP}, logger)
+	is.NoErr(err)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Second)
+	defer cancelShutdown()
+	defer client.Shutdown(shutdownCtx) // its session is closed by the server, so nothing is drained
+	local, remote := net.Pipe()
+	defer local.Close()
+	is.NoErr(client.HandleConnection(router.NewEndpoint("tcp", echo.Addr().String()), remote))
+	go local.Write([]byte("hello"))
+	_, err = io.ReadFull(local, make([]byte, 5))
+	is.NoErr(err)
+
+	reloaded := *conf
+	is.NoErr(reloaded.RemoveUser("alice"))
+	_, err = reloaded.AddUser("alice") // same name, new key
+	is.NoErr(err)
+	_, err = server.Reload(&reloaded)
+	is.NoErr(err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var streams, connected int
+		for _, session := range server.Sessions() {
+			if session.Name == "alice" {
+				streams += len(session.Streams)
+				if session.State == router.Connected.String() {
+					connected++
+				}
+			}
+		}
+		if streams == 0 && connected == 0 {
+			break
+		}
+		is.True(time.Now().Before(deadline)) // the session of alice is still open
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = local.Read(make([]byte, 1))
+	is.True(err == io.EOF) // the client closed the stream too
+}
+
+// TestRedial checks that a client with a single tunnel dials the server again once the tunnel has failed.
+func TestRedial(t *testing.T) {
+	is := is.New(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	conf := &config.Configuration{
+		Role:      "server",
+		Protocol:  "tcp",
+		AuthToken: base64.RawStdEncoding.EncodeToString(frand.Bytes(32)),
+		TCP:       &config.TCPConfig{ServerAddr: "127.0.0.1", ServerPort: freePort(is)},
+	}
+	server, err := NewServer(conf, logger)
+	is.NoErr(err)
+	go server.Start(ctx)
+	waitListening(is, conf.TCP.ServerPort)
+
+	client, err := NewClient(&config.Configuration{Role: "client", Protocol: "tcp", AuthToken: conf.AuthToken, TCP: conf.TCP}, logger)
+	is.NoErr(err)
+	defer client.Shutdown(context.Background())
+	echoThrough := func() net.Conn {
+		local, remote := net.Pipe()
+		is.NoErr(client.HandleConnection(router.NewEndpoint("tcp", echo.Addr().String()), remote))
+		go local.Write([]byte("hello"))
+		local.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.ReadFull(local, make([]byte, 5))
+		is.NoErr(err)
+		return local
+	}
+	first := echoThrough()
+	defer first.Close()
+
+	is.True(server.CloseSession(config.DefaultUser)) // drops the tunnel
+	failed := false
+	for reconnected := false; !reconnected; {
+		select {
+		case change := <-client.StateChanges():
+			failed = failed || change.State == router.Failed
+			reconnected = failed && change.State == router.Connected
+		case <-time.After(5 * time.Second):
+			t.Fatal("the client did not dial again")
+		}
+	}
+
+	_, err = first.Read(make([]byte, 1))
+	is.True(err == io.EOF) // the stream went through the failed tunnel
+	second := echoThrough()
+	second.Close()
+}
+
+func freePort(is *is.I) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func waitListening(is *is.I, port int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err == nil {
+			conn.Close()
+			return
+		}
+		is.True(time.Now().Before(deadline)) // server did not start
+		time.Sleep(10 * time.Millisecond)
+	}
+}
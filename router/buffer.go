@@ -0,0 +1,35 @@
+package router
+
+import "sync"
+
+// MaxDataSize is the most data that a packet read from a connection carries, the same as the largest TLS record.
+// Reads are no larger than this, which keeps the frames of tunnels small and lets the read buffers be pooled.
+const MaxDataSize = 16 * 1024
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, MaxDataSize)
+		return &b
+	},
+}
+
+func getBuffer() []byte {
+	return *buffers.Get().(*[]byte)
+}
+
+func putBuffer(b []byte) {
+	b = b[:MaxDataSize]
+	buffers.Put(&b)
+}
+
+// Recycle gives the buffers of packets taken by Fill back to the router once they have been sent, so that they can
+// be reused for reading. The data of the packets must not be used afterwards. Calling it is optional, as buffers
+// that are not given back are garbage collected, but it saves allocating a buffer for every read.
+func Recycle(packets []Packet) {
+	for i := range packets {
+		if cap(packets[i].Data) == MaxDataSize {
+			putBuffer(packets[i].Data)
+		}
+		packets[i] = Packet{}
+	}
+}
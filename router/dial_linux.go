@@ -0,0 +1,16 @@
+package router
+
+import "syscall"
+
+// bindToDevice returns a net.Dialer control function that binds sockets to a network interface with SO_BINDTODEVICE.
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if controlErr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), iface)
+		}); controlErr != nil {
+			return controlErr
+		}
+		return err
+	}, nil
+}
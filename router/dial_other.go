@@ -0,0 +1,12 @@
+//go:build !linux
+
+package router
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("binding to an interface is only supported on Linux")
+}
@@ -0,0 +1,218 @@
+package router
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/awnumar/rosen/logging"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Smallest number of bytes that a limiter lets through at once, so that slow rates do not split every read.
+	minBurst = 32 * 1024
+
+	// How often streams are checked against the idle timeout and maximum lifetime.
+	reapInterval = time.Second
+
+	// How often the data passed by open streams is added to the meter of their router.
+	meterInterval = time.Second
+)
+
+// Limiter caps the rate of the data that passes between routers and their connections, in each direction separately.
+// It may be shared between routers, and its rate changed while it is in use.
+type Limiter struct {
+	in  *rate.Limiter // from the tunnel, written to connections
+	out *rate.Limiter // read from connections, sent through the tunnel
+}
+
+// NewLimiter returns a limiter of bytesPerSecond in each direction. A rate of 0 is unlimited.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	limit, burst := limitOf(bytesPerSecond)
+	return &Limiter{
+		in:  rate.NewLimiter(limit, burst),
+		out: rate.NewLimiter(limit, burst),
+	}
+}
+
+func limitOf(bytesPerSecond int64) (rate.Limit, int) {
+	if bytesPerSecond <= 0 {
+		return rate.Inf, minBurst
+	}
+	if bytesPerSecond < minBurst {
+		return rate.Limit(bytesPerSecond), minBurst
+	}
+	return rate.Limit(bytesPerSecond), int(bytesPerSecond) // up to a second's worth at once
+}
+
+// SetRate changes the rate of the limiter. A rate of 0 is unlimited.
+func (l *Limiter) SetRate(bytesPerSecond int64) {
+	limit, burst := limitOf(bytesPerSecond)
+	for _, r := range []*rate.Limiter{l.in, l.out} {
+		r.SetBurst(burst)
+		r.SetLimit(limit)
+	}
+}
+
+// rate returns the rate of the limiter in bytes per second, or 0 if it is unlimited.
+func (l *Limiter) rate() int64 {
+	if l.in.Limit() == rate.Inf {
+		return 0
+	}
+	return int64(l.in.Limit())
+}
+
+// wait blocks until n bytes may pass in the given direction, or until ctx is done.
+// Blocking the handlers of a stream is what pushes back on its connection and on the tunnel, so nothing is dropped.
+func (l *Limiter) wait(ctx context.Context, out bool, n int) error {
+	r := l.in
+	if out {
+		r = l.out
+	}
+	for n > 0 {
+		chunk := n
+		if burst := r.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if err := r.WaitN(ctx, chunk); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			continue // the burst was lowered by SetRate in the meantime
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// waitAll blocks until n bytes may pass every limiter.
+func waitAll(ctx context.Context, limiters []*Limiter, out bool, n int) error {
+	for _, l := range limiters {
+		if err := l.wait(ctx, out, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithLimiter makes the router wait on l before passing data between its connections and the tunnel.
+// It can be given more than once, for example for a limit per user and one shared by every user.
+func WithLimiter(l *Limiter) Option {
+	return func(r *Router) {
+		r.limiters = append(r.limiters, l)
+	}
+}
+
+// WithStreamLimit gives every new stream a limiter of its own, with the rate that l has when the stream is opened.
+func WithStreamLimit(l *Limiter) Option {
+	return func(r *Router) {
+		r.streamLimit = l
+	}
+}
+
+// StreamLimits caps the streams of a router. Zero values are unlimited.
+type StreamLimits struct {
+	// MaxStreams is the number of streams that can be open at once.
+	MaxStreams int
+
+	// IdleTimeout closes streams that have not passed data in either direction for this long.
+	IdleTimeout time.Duration
+
+	// MaxLifetime closes streams that have been open for this long.
+	MaxLifetime time.Duration
+}
+
+// WithStreamLimits caps the streams of the router. limits is called whenever a stream is opened and whenever the
+// streams are checked, so that they can be changed while the router is in use.
+func WithStreamLimits(limits func() StreamLimits) Option {
+	return func(r *Router) {
+		r.streamLimits = limits
+	}
+}
+
+// reap closes the streams that have been idle or open for longer than the limits allow, which tells the remote end
+// about them as well. It returns once the router is closed and has no streams left.
+func (r *Router) reap() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.mutex.Lock()
+		finished := r.closing && r.streams == 0
+		r.mutex.Unlock()
+		if finished {
+			return
+		}
+
+		limits := r.streamLimits()
+		now := time.Now()
+		r.handlers.Range(func(id, pipeInterface interface{}) bool {
+			pipe := pipeInterface.(*pipe)
+			var reason string
+			switch {
+			case pipe.closed():
+				return true
+			case limits.IdleTimeout > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&pipe.lastActive))) > limits.IdleTimeout:
+				reason = "idle timeout"
+			case limits.MaxLifetime > 0 && now.Sub(pipe.opened) > limits.MaxLifetime:
+				reason = "maximum lifetime"
+			default:
+				return true
+			}
+			r.logger.Debug("closing stream", slog.String(logging.StreamKey, id.(string)), "reason", reason)
+			pipe.shutdown()
+			return true
+		})
+	}
+}
+
+// Meter accounts for the data that passes between a router and its connections, and can refuse new streams,
+// for example once a quota has been used up.
+type Meter interface {
+	// Allow returns the reason why a new stream must not be opened, if any.
+	Allow() error
+
+	// Add accounts for data received through the tunnel and written to a connection (in),
+	// and data read from a connection and sent through the tunnel (out).
+	Add(in, out uint64)
+}
+
+// WithMeter makes the router account for its data with m, and refuse new streams that m does not allow.
+func WithMeter(m Meter) Option {
+	return func(r *Router) {
+		r.meter = m
+	}
+}
+
+// meterUsage adds the data that a stream has passed since it was last metered to the meter of the router. Streams
+// count their data themselves, so that the meter is not locked for every packet.
+func (r *Router) meterUsage(p *pipe) {
+	if r.meter == nil {
+		return
+	}
+	in, out := atomic.SwapUint64(&p.unmeteredIn, 0), atomic.SwapUint64(&p.unmeteredOut, 0)
+	if in > 0 || out > 0 {
+		r.meter.Add(in, out)
+	}
+}
+
+// flushUsage meters the open streams every meterInterval, as well as when they are closed. It returns once the
+// router is closed and has no streams left.
+func (r *Router) flushUsage() {
+	ticker := time.NewTicker(meterInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.mutex.Lock()
+		finished := r.closing && r.streams == 0
+		r.mutex.Unlock()
+		if finished {
+			return
+		}
+		r.handlers.Range(func(_, pipeInterface interface{}) bool {
+			r.meterUsage(pipeInterface.(*pipe))
+			return true
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package router
+
+import (
+	"sync"
+
+	"github.com/awnumar/rosen/metrics"
+)
+
+var (
+	// TunnelsActive counts the tunnels that are up, by protocol. On a server there is one per connected client.
+	TunnelsActive = metrics.Default.NewGauge("rosen_tunnels", "Tunnels that are up.", "protocol")
+
+	// AuthFailures counts connections and requests that did not carry a valid key, by protocol.
+	AuthFailures = metrics.Default.NewCounter("rosen_auth_failures_total", "Connections or requests rejected for not carrying a valid key.", "protocol")
+
+	streamsActive = metrics.Default.NewGauge("rosen_router_streams", "Streams that are open.", "router")
+	bytesTotal    = metrics.Default.NewCounter("rosen_router_bytes_total",
+		"Bytes carried by streams. Out is read from connections and sent through the tunnel, in is received from the tunnel and written to connections.",
+		"router", "direction")
+	dialFailures = metrics.Default.NewCounter("rosen_router_dial_failures_total", "Streams that could not be opened, by class of error.", "class")
+	_            = metrics.Default.NewGaugeFunc("rosen_router_queue_length", "Packets waiting to be sent through the tunnel.", collectQueueLengths, "router")
+
+	named sync.Map // name => *Router, for collecting the queue lengths
+)
+
+func collectQueueLengths(set func(int64, ...string)) {
+	named.Range(func(name, r interface{}) bool {
+		set(int64(r.(*Router).QueueLen()), name.(string))
+		return true
+	})
+}
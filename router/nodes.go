@@ -1,15 +1,92 @@
 package router
 
 import (
+	"context"
 	"net"
 )
 
 // Client implements the client-side of a tunnel.
 type Client interface {
 	HandleConnection(dest Endpoint, conn net.Conn) error
+
+	// Shutdown stops accepting new streams, closes the open ones and waits until the remote end
+	// has been told about it, or until ctx is done.
+	Shutdown(ctx context.Context) error
 }
 
 // Server implements the server-side of a tunnel.
 type Server interface {
-	Start() error
+	// Start serves until ctx is cancelled, after which no new streams are accepted. Connections from clients
+	// may be kept up until Shutdown, as they are needed to drain the open streams.
+	Start(ctx context.Context) error
+
+	// Shutdown closes the open streams, waits until clients have been told about it or until ctx is done,
+	// and then closes every connection.
+	Shutdown(ctx context.Context) error
+}
+
+// Inspector is implemented by clients and servers that can report on their sessions and close them.
+// A client has a single session with its server, and a server has one per user.
+type Inspector interface {
+	Sessions() []SessionInfo
+
+	// CloseSession closes every stream of a session. Servers that keep a connection per session drop it as well.
+	CloseSession(name string) bool
+
+	CloseStream(id string) bool
+}
+
+// ClientSession is the name of the session of a client.
+const ClientSession = "client"
+
+// SessionInfo describes a session and its open streams.
+type SessionInfo struct {
+	Name    string       `json:"name"`
+	State   string       `json:"state"`
+	Server  string       `json:"server,omitempty"` // the server that a client with several is using
+	Streams []StreamInfo `json:"streams"`
+}
+
+// State describes the health of a client's session with its server.
+type State int
+
+const (
+	// Connecting means that no request has succeeded yet.
+	Connecting State = iota
+
+	// Connected means that the last exchange with the server succeeded.
+	Connected State = iota
+
+	// Degraded means that recent exchanges failed and are being retried.
+	Degraded State = iota
+
+	// Failed means that the session was lost. Open streams have been reset, and the client keeps trying to reconnect.
+	Failed State = iota
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Degraded:
+		return "degraded"
+	case Failed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// StateChange is emitted by clients whenever their State changes. Err holds the error that caused it, if any.
+type StateChange struct {
+	State State
+	Err   error
+}
+
+// StateNotifier is implemented by clients that report changes in the state of their session.
+type StateNotifier interface {
+	State() State
+	StateChanges() <-chan StateChange
 }
@@ -1,5 +1,7 @@
 package router
 
+import "encoding/binary"
+
 // PacketType gives some information about the state of the connection that a packet belongs to.
 type PacketType int
 
@@ -12,6 +14,31 @@ const (
 
 	// Close signals to close the connection and clean up.
 	Close PacketType = iota
+
+	// Ping asks the remote end of a tunnel to answer with a Pong that carries the same data.
+	// Pings and pongs belong to the tunnel rather than to a connection, and are not passed to routers.
+	Ping PacketType = iota
+
+	// Pong answers a Ping.
+	Pong PacketType = iota
+
+	// Join asks the remote end to add a tunnel to a group of tunnels; see tunnel.Group. ID names the group and Data
+	// the tunnel. The remote end answers with the same packet.
+	Join PacketType = iota
+
+	// Frame starts a numbered run of packets sent through a group of tunnels. ID names the tunnel that the run was
+	// first queued on and Data holds its number.
+	Frame PacketType = iota
+
+	// Ack tells the remote end of a group of tunnels that the frames of a tunnel up to a number have been received.
+	Ack PacketType = iota
+
+	// Leave tells the remote end of a group of tunnels that a tunnel has failed.
+	Leave PacketType = iota
+
+	// Window lets the remote end send the data of a stream up to an offset, which Data holds. Routers only send it
+	// to remote ends that asked for it by putting the size of their window in the Data of an Open packet.
+	Window PacketType = iota
 )
 
 // Packet holds a single message to or from the server.
@@ -64,6 +91,80 @@ func DataPacket(id string, data []byte) Packet {
 	}
 }
 
+// PingPacket returns a message asking the remote end of a tunnel to answer with the same data.
+func PingPacket(data []byte) Packet {
+	return Packet{
+		Data: data,
+		Type: Ping,
+	}
+}
+
+// PongPacket returns the answer to a ping that carried data.
+func PongPacket(data []byte) Packet {
+	return Packet{
+		Data: data,
+		Type: Pong,
+	}
+}
+
+// JoinPacket returns a message asking to add a tunnel to a group.
+func JoinPacket(group, tunnel string) Packet {
+	return Packet{
+		ID:   group,
+		Data: []byte(tunnel),
+		Type: Join,
+	}
+}
+
+// FramePacket returns a message that starts a frame of a tunnel.
+func FramePacket(tunnel string, seq uint64) Packet {
+	return Packet{
+		ID:   tunnel,
+		Data: seqBytes(seq),
+		Type: Frame,
+	}
+}
+
+// AckPacket returns a message acknowledging the frames of a tunnel up to seq.
+func AckPacket(tunnel string, seq uint64) Packet {
+	return Packet{
+		ID:   tunnel,
+		Data: seqBytes(seq),
+		Type: Ack,
+	}
+}
+
+// WindowPacket returns a message letting the remote end send the data of a stream up to offset.
+func WindowPacket(id string, offset uint64) Packet {
+	return Packet{
+		ID:   id,
+		Data: seqBytes(offset),
+		Type: Window,
+	}
+}
+
+// LeavePacket returns a message saying that a tunnel has failed.
+func LeavePacket(tunnel string) Packet {
+	return Packet{
+		ID:   tunnel,
+		Type: Leave,
+	}
+}
+
+// Seq returns the number carried by a Frame, Ack or Window packet, or by an Open packet that asks for a window.
+func (p Packet) Seq() uint64 {
+	if len(p.Data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(p.Data)
+}
+
+func seqBytes(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
 // ClosePacket returns a message indicating a closed connection.
 func ClosePacket(id string) Packet {
 	return Packet{
@@ -71,3 +172,13 @@ func ClosePacket(id string) Packet {
 		Type: Close,
 	}
 }
+
+// RefusePacket returns a Close packet for a stream that could not be opened, whose Data tells the remote end why, such
+// as a used up quota. Older versions ignore the data of Close packets.
+func RefusePacket(id string, reason error) Packet {
+	return Packet{
+		ID:   id,
+		Data: []byte(reason.Error()),
+		Type: Close,
+	}
+}
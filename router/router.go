@@ -1,106 +1,437 @@
 package router
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
+	"log/slog"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/awnumar/rosen/logging"
+	"github.com/awnumar/rosen/metrics"
 
 	"lukechampine.com/frand"
 )
 
 const (
-	fromConnsChannelBufferSize = 4096
-	toConnChannelBufferSize    = 4096
+	// Bytes of a stream that may be on their way to the remote end before it has written the earlier ones to its
+	// connection. The remote end lets more through as it writes them, so a stream whose connection is slow to take
+	// data, for example because it is rate limited, holds up only itself.
+	streamWindow = 128 * MaxDataSize
+
+	// Bytes received for a stream that may wait to be written to its connection. Remote ends that do not keep to the
+	// window, such as older versions, can send more than it, and their streams are closed past this.
+	maxBacklog = 4 * streamWindow
+
+	// How often Shutdown checks whether the outbound queue has drained.
+	drainPollInterval = 10 * time.Millisecond
 )
 
+// ErrClosed is returned by HandleConnection once the router no longer accepts new streams.
+var ErrClosed = errors.New("router is not accepting new streams")
+
+// ErrTooManyStreams is returned by HandleConnection when the router has as many streams open as its limits allow.
+var ErrTooManyStreams = errors.New("too many open streams")
+
 // Router is a black-box structure that will route data between the caller and multiple connections.
 type Router struct {
-	fromConns chan Packet
-	handlers  *sync.Map // string => *pipe
+	outbound *scheduler
+	handlers *sync.Map // string => *pipe
+	logger   *slog.Logger
+	name     string
+	weight   func(port int) int
+	dialer   Dialer
+
+	// metric series of the router, looked up once
+	bytesIn, bytesOut *metrics.Counter
+	streamsActive     *metrics.Gauge
+
+	limiters     []*Limiter
+	streamLimit  *Limiter
+	meter        Meter
+	streamLimits func() StreamLimits
+
+	mutex   sync.Mutex // guards closing, streams and adding to readers
+	closing bool
+	streams int            // number of open streams
+	readers sync.WaitGroup // one per stream, until its Close packet is queued
 }
 
 type pipe struct {
-	toConn chan Packet
-	close  uint32
+	queue  *queue // of packets to be sent through the tunnel
+	done   chan struct{}
+	once   sync.Once
+	dest   Endpoint
+	opened time.Time
+
+	mutex        sync.Mutex // guards conn, backlog and backlogBytes
+	conn         net.Conn   // nil until a stream opened by the remote end is connected
+	backlog      []Packet   // received from the remote end, waiting to be written to conn
+	backlogBytes int
+	wake         chan struct{} // receives when packets are added to backlog
+
+	// limit is the offset up to which data may be sent to the remote end, once windowed is set. credit receives when
+	// it is raised. grants is set if the remote end is told how much it may send, up to granted.
+	windowed int32
+	limit    uint64
+	credit   chan struct{}
+	grants   int32
+	granted  uint64 // only used by the handler that writes to conn
+
+	// limiters are waited on before data is passed on. ctx is cancelled with done so that waiting stops.
+	limiters []*Limiter
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	bytesIn    uint64 // written to conn, updated atomically
+	bytesOut   uint64 // read from conn, updated atomically
+	lastActive int64  // when data was last passed in either direction, in Unix nanoseconds, updated atomically
+
+	// bytes that have not been added to the router's meter yet, updated atomically
+	unmeteredIn, unmeteredOut uint64
+
+	// remoteClosed is set when the remote end closed the stream, so it need not be told about it.
+	remoteClosed int32
+}
+
+// shutdown closes the connection and stops the handlers. It is safe to call more than once.
+func (p *pipe) shutdown() {
+	p.once.Do(func() {
+		close(p.done)
+		p.cancel()
+		p.mutex.Lock()
+		conn := p.conn
+		p.mutex.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+	})
+}
+
+// active records that data was passed.
+func (p *pipe) active() {
+	atomic.StoreInt64(&p.lastActive, time.Now().UnixNano())
+}
+
+func (p *pipe) closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver adds a packet from the remote end to the backlog, and reports whether the backlog is too long.
+func (p *pipe) deliver(packet Packet) (overflow bool) {
+	p.mutex.Lock()
+	p.backlog = append(p.backlog, packet)
+	p.backlogBytes += len(packet.Data)
+	overflow = p.backlogBytes > maxBacklog
+	p.mutex.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return overflow
+}
+
+// next waits for the next packet of the backlog. It returns false once the stream is closed.
+func (p *pipe) next() (Packet, bool) {
+	for {
+		p.mutex.Lock()
+		if len(p.backlog) > 0 {
+			packet := p.backlog[0]
+			p.backlog[0] = Packet{}
+			p.backlog = p.backlog[1:]
+			if len(p.backlog) == 0 {
+				p.backlog = nil
+			}
+			p.backlogBytes -= len(packet.Data)
+			p.mutex.Unlock()
+			return packet, true
+		}
+		p.mutex.Unlock()
+		select {
+		case <-p.wake:
+		case <-p.done:
+			return Packet{}, false
+		}
+	}
+}
+
+// grant raises the offset up to which data may be sent to the remote end.
+func (p *pipe) grant(offset uint64) {
+	for {
+		limit := atomic.LoadUint64(&p.limit)
+		if offset <= limit || atomic.CompareAndSwapUint64(&p.limit, limit, offset) {
+			break
+		}
+	}
+	atomic.StoreInt32(&p.windowed, 1)
+	select {
+	case p.credit <- struct{}{}:
+	default:
+	}
+}
+
+// waitCredit blocks until n more bytes may be sent to the remote end, or until the stream is closed. Remote ends that
+// have not granted a window are sent data as fast as it is read.
+func (p *pipe) waitCredit(n int) error {
+	for atomic.LoadInt32(&p.windowed) == 1 && atomic.LoadUint64(&p.bytesOut)+uint64(n) > atomic.LoadUint64(&p.limit) {
+		select {
+		case <-p.credit:
+		case <-p.done:
+			return ErrClosed
+		}
+	}
+	return nil
+}
+
+// Option configures a Router.
+type Option func(*Router)
+
+// WithLogger sets the logger that the router, and the tunnels proxying for it, log to.
+// The default is slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(r *Router) {
+		r.logger = logger
+	}
+}
+
+// WithName names the router in metrics, for example after the user that it belongs to.
+func WithName(name string) Option {
+	return func(r *Router) {
+		r.name = name
+	}
 }
 
 // NewRouter initialises a new Router object.
-func NewRouter() *Router {
-	return &Router{
-		fromConns: make(chan Packet, fromConnsChannelBufferSize),
-		handlers:  &sync.Map{},
+func NewRouter(opts ...Option) *Router {
+	r := &Router{
+		outbound: &scheduler{ready: make(chan struct{}, 1)},
+		handlers: &sync.Map{},
+		logger:   slog.Default(),
+		dialer:   defaultDialer,
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+	r.bytesIn = bytesTotal.With(r.name, "in")
+	r.bytesOut = bytesTotal.With(r.name, "out")
+	r.streamsActive = streamsActive.With(r.name)
+	if r.name != "" {
+		named.Store(r.name, r)
+	}
+	if r.streamLimits != nil {
+		go r.reap()
+	}
+	if r.meter != nil {
+		go r.flushUsage()
+	}
+	return r
+}
+
+// Logger returns the logger of the router.
+func (r *Router) Logger() *slog.Logger {
+	return r.logger
 }
 
 // RouterConnection will start handlers for a connection that wishes to talk to a given endpoint.
 // If conn == nil, a connection to the given endpoint will be opened.
-// Otherwise, a packet containing instructions to open a connection is sent on the p.fromConns channel.
+// Otherwise, a packet containing instructions to open a connection is queued to be sent through the tunnel.
 func (r *Router) HandleConnection(dest Endpoint, conn net.Conn) (err error) {
 	id := base64.RawStdEncoding.EncodeToString(frand.Bytes(16))
-	return r.handleConnection(id, dest, conn)
+	return r.handleConnection(id, dest, conn, 0)
 }
 
-func (r *Router) handleConnection(id string, dest Endpoint, conn net.Conn) (err error) {
-	if conn == nil {
-		conn, err = net.Dial(dest.Network, dest.Address)
-		if err != nil {
+// handleConnection starts a stream. Streams opened by the remote end are given conn == nil, and window is the window
+// that the remote end asked for, if any. They are connected in the background, while what the remote end sends waits
+// in the backlog, so that the tunnel is not held up.
+func (r *Router) handleConnection(id string, dest Endpoint, conn net.Conn, window uint64) (err error) {
+	r.mutex.Lock()
+	if r.closing {
+		r.mutex.Unlock()
+		return ErrClosed
+	}
+	if r.streamLimits != nil {
+		if max := r.streamLimits().MaxStreams; max > 0 && r.streams >= max {
+			r.mutex.Unlock()
+			return ErrTooManyStreams
+		}
+	}
+	r.streams++
+	r.readers.Add(1)
+	r.mutex.Unlock()
+
+	if r.meter != nil {
+		if err := r.meter.Allow(); err != nil {
+			r.mutex.Lock()
+			r.streams--
+			r.mutex.Unlock()
+			r.readers.Done()
 			return err
 		}
-	} else {
-		r.fromConns <- NewPacket(id, dest)
 	}
 
-	toConn := make(chan Packet, toConnChannelBufferSize)
-	pipe := &pipe{toConn: toConn}
+	pipe := &pipe{
+		queue:  newQueue(r.weightOf(dest)),
+		done:   make(chan struct{}),
+		dest:   dest,
+		opened: time.Now(),
+		wake:   make(chan struct{}, 1),
+		credit: make(chan struct{}, 1),
+	}
+	pipe.active()
+	pipe.limiters = r.limiters
+	if r.streamLimit != nil {
+		pipe.limiters = append([]*Limiter{NewLimiter(r.streamLimit.rate())}, r.limiters...)
+	}
+	pipe.ctx, pipe.cancel = context.WithCancel(context.Background())
 	r.handlers.Store(id, pipe)
 
+	if conn != nil {
+		pipe.conn = conn
+		pipe.granted = streamWindow
+		open := NewPacket(id, dest)
+		open.Data = seqBytes(streamWindow)
+		r.outbound.push(pipe.queue, open)
+		r.serve(id, pipe, conn)
+		return nil
+	}
+
+	if window > 0 {
+		pipe.grant(window)
+		pipe.grants = 1
+		pipe.granted = streamWindow
+		r.outbound.pushControl(WindowPacket(id, streamWindow))
+	}
+	go func() {
+		conn, err := r.dialer.DialContext(pipe.ctx, dest.Network, dest.Address)
+		if err == nil {
+			pipe.mutex.Lock()
+			if pipe.closed() {
+				conn.Close()
+				err = ErrClosed
+			} else {
+				pipe.conn = conn
+			}
+			pipe.mutex.Unlock()
+		}
+		if err != nil {
+			if !pipe.closed() {
+				dialFailures.With(logging.ErrorClass(err)).Inc()
+				r.logger.Warn("failed to open stream", slog.String(logging.StreamKey, id), logging.Dest(dest.Address), logging.Err(err))
+			}
+			pipe.shutdown()
+			if atomic.LoadInt32(&pipe.remoteClosed) == 0 {
+				r.outbound.push(pipe.queue, ClosePacket(id)) // so that the remote end does not wait on it
+			}
+			r.handlers.Delete(id)
+			r.mutex.Lock()
+			r.streams--
+			r.mutex.Unlock()
+			r.readers.Done()
+			return
+		}
+		r.serve(id, pipe, conn)
+	}()
+	return nil
+}
+
+// serve starts the handlers that pass data between a connected stream and the tunnel.
+func (r *Router) serve(id string, pipe *pipe, conn net.Conn) {
+	r.streamsActive.Inc()
+	r.logger.Debug("stream opened", slog.String(logging.StreamKey, id), logging.Dest(pipe.dest.Address))
+
 	go func() {
-		for message := range toConn {
+		defer r.meterUsage(pipe)
+		defer pipe.shutdown()
+		for {
+			message, ok := pipe.next()
+			if !ok {
+				return
+			}
+
 			// sanity check
 			if message.ID != id {
 				panic("received a message intended for a different client; please report this issue")
 			}
 
 			if message.Closed() {
-				break
+				atomic.StoreInt32(&pipe.remoteClosed, 1)
+				return
 			}
 
-			_, err = conn.Write(message.Data)
-			if err != nil {
-				r.fromConns <- ClosePacket(message.ID)
-				break
+			if err := waitAll(pipe.ctx, pipe.limiters, false, len(message.Data)); err != nil {
+				return
+			}
+			n := uint64(len(message.Data))
+			r.bytesIn.Add(n)
+			written := atomic.AddUint64(&pipe.bytesIn, n)
+			atomic.AddUint64(&pipe.unmeteredIn, n)
+			pipe.active()
+			if _, err := conn.Write(message.Data); err != nil {
+				r.outbound.push(pipe.queue, ClosePacket(message.ID))
+				return
+			}
+
+			// The window is moved on once half of it has been written, rather than for every packet.
+			if atomic.LoadInt32(&pipe.grants) == 1 && written+streamWindow >= pipe.granted+streamWindow/2 {
+				pipe.granted = written + streamWindow
+				r.outbound.pushControl(WindowPacket(id, pipe.granted))
 			}
 		}
-		atomic.StoreUint32(&pipe.close, 1)
-		conn.Close()
 	}()
 
 	go func() {
-		copyBuf := func(buf []byte) []byte {
-			c := make([]byte, len(buf))
-			copy(c, buf)
-			return c
-		}
-		var readBuf [4000000]byte
+		defer r.readers.Done()
 		for {
-			n, err := conn.Read(readBuf[:])
+			// The buffer is handed over with the packet, and given back by Recycle once the packet has been sent.
+			buf := getBuffer()
+			n, err := conn.Read(buf)
 			if n > 0 {
-				r.fromConns <- DataPacket(id, copyBuf(readBuf[:n]))
+				waitErr := pipe.waitCredit(n)
+				if waitErr == nil {
+					waitErr = waitAll(pipe.ctx, pipe.limiters, true, n)
+				}
+				if waitErr != nil {
+					err = waitErr // closed while waiting
+					putBuffer(buf)
+				} else {
+					r.bytesOut.Add(uint64(n))
+					atomic.AddUint64(&pipe.bytesOut, uint64(n))
+					atomic.AddUint64(&pipe.unmeteredOut, uint64(n))
+					pipe.active()
+					r.outbound.push(pipe.queue, DataPacket(id, buf[:n]))
+				}
+			} else {
+				putBuffer(buf)
 			}
 			if err != nil {
-				r.fromConns <- ClosePacket(id)
+				if atomic.LoadInt32(&pipe.remoteClosed) == 0 {
+					r.outbound.push(pipe.queue, ClosePacket(id))
+				}
 				break
 			}
 		}
-		atomic.StoreUint32(&pipe.close, 1)
-		conn.Close()
+		pipe.shutdown()
+		r.handlers.Delete(id)
+		r.meterUsage(pipe)
+		r.mutex.Lock()
+		r.streams--
+		r.mutex.Unlock()
+		r.streamsActive.Dec()
+		r.logger.Debug("stream closed", slog.String(logging.StreamKey, id))
 	}()
-
-	return nil
 }
 
-// Ingest takes a list of packets and handles them, forwarding data to the right handlers.
+// Ingest takes a list of packets and handles them, forwarding data to the right handlers. It does not wait on the
+// connections of streams: what they have not taken yet waits in a backlog per stream, which the window keeps short.
 func (r *Router) Ingest(data []Packet) {
 	for i := range data {
 		id := data[i].ID
@@ -108,36 +439,153 @@ func (r *Router) Ingest(data []Packet) {
 		pipeInterface, exists := r.handlers.Load(id)
 		if !exists {
 			if data[i].NewConnection() {
-				r.handleConnection(data[i].ID, data[i].Dest, nil)
+				if err := r.handleConnection(data[i].ID, data[i].Dest, nil, data[i].Seq()); err != nil {
+					refusal := ClosePacket(id) // so that the remote end does not wait on it
+					if err != ErrClosed {
+						r.logger.Warn("failed to open stream", slog.String(logging.StreamKey, id), logging.Dest(data[i].Dest.Address), logging.Err(err))
+						refusal = RefusePacket(id, err)
+					}
+					r.outbound.pushControl(refusal)
+				}
 			}
 			continue
 		}
 		pipe := pipeInterface.(*pipe) // will panic if can't assert type
 
-		if atomic.LoadUint32(&pipe.close) == 1 {
+		if pipe.closed() {
 			r.handlers.Delete(id)
-			close(pipe.toConn)
 			continue
 		}
 
-		pipe.toConn <- data[i]
+		switch {
+		case data[i].Type == Window:
+			if atomic.LoadInt32(&pipe.grants) == 0 {
+				atomic.StoreInt32(&pipe.grants, 1) // the remote end keeps to the window it was offered in the Open packet
+			}
+			pipe.grant(data[i].Seq())
+		case data[i].Closed():
+			if len(data[i].Data) > 0 {
+				r.logger.Warn("stream refused by the remote end", slog.String(logging.StreamKey, id), logging.Dest(pipe.dest.Address),
+					"reason", string(data[i].Data))
+			}
+			atomic.StoreInt32(&pipe.remoteClosed, 1)
+			pipe.deliver(data[i])
+		default:
+			if pipe.deliver(data[i]) {
+				r.logger.Warn("closing stream that is sent more data than it can take", slog.String(logging.StreamKey, id))
+				pipe.shutdown()
+			}
+		}
 	}
 }
 
-// QueueLen returns the number of packets waiting on the aggregate channel of data from connections.
-func (r *Router) QueueLen() int {
-	return len(r.fromConns)
+// Reset closes every connection handled by the router and drops the packets that they have waiting, for example when
+// the session with the remote end has been lost and the streams can no longer make progress.
+func (r *Router) Reset() {
+	r.handlers.Range(func(id, pipeInterface interface{}) bool {
+		pipeInterface.(*pipe).shutdown()
+		r.outbound.dropQueue(pipeInterface.(*pipe).queue)
+		r.handlers.Delete(id)
+		return true
+	})
 }
 
-// Fill tries to fill provided buffer with waiting items from the connections' outbound queue.
-// It returns the number of packets written.
-func (r *Router) Fill(buffer []Packet) int {
-	size := r.QueueLen()
-	if size > len(buffer) {
-		size = len(buffer)
+// StreamInfo describes an open stream.
+type StreamInfo struct {
+	ID       string    `json:"id"`
+	Dest     Endpoint  `json:"dest"`
+	BytesIn  uint64    `json:"bytesIn"`  // received through the tunnel
+	BytesOut uint64    `json:"bytesOut"` // sent through the tunnel
+	Opened   time.Time `json:"opened"`
+}
+
+// Streams returns the streams that are open, oldest first.
+func (r *Router) Streams() []StreamInfo {
+	streams := []StreamInfo{}
+	r.handlers.Range(func(id, pipeInterface interface{}) bool {
+		pipe := pipeInterface.(*pipe)
+		if pipe.closed() {
+			return true
+		}
+		streams = append(streams, StreamInfo{
+			ID:       id.(string),
+			Dest:     pipe.dest,
+			BytesIn:  atomic.LoadUint64(&pipe.bytesIn),
+			BytesOut: atomic.LoadUint64(&pipe.bytesOut),
+			Opened:   pipe.opened,
+		})
+		return true
+	})
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].Opened.Before(streams[j].Opened)
+	})
+	return streams
+}
+
+// CloseStream closes the connection of a stream, which tells the remote end about it as well.
+// It returns false if there is no such stream.
+func (r *Router) CloseStream(id string) bool {
+	pipeInterface, exists := r.handlers.Load(id)
+	if !exists || pipeInterface.(*pipe).closed() {
+		return false
 	}
-	for i := 0; i < size; i++ {
-		buffer[i] = <-r.fromConns
+	pipeInterface.(*pipe).shutdown()
+	return true
+}
+
+// Close stops the router from accepting new streams from either end. Streams that are already open are unaffected.
+func (r *Router) Close() {
+	r.mutex.Lock()
+	r.closing = true
+	r.mutex.Unlock()
+}
+
+// Shutdown stops the router from accepting new streams and closes the open ones, which queues a Close packet
+// for each of them. It then waits until every queued packet has been taken by Fill, or until ctx is done.
+func (r *Router) Shutdown(ctx context.Context) error {
+	r.Close()
+	r.handlers.Range(func(_, pipeInterface interface{}) bool {
+		pipeInterface.(*pipe).shutdown()
+		return true
+	})
+
+	readersDone := make(chan struct{})
+	go func() {
+		r.readers.Wait()
+		close(readersDone)
+	}()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-readersDone:
+			if r.QueueLen() == 0 {
+				return nil
+			}
+		default:
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
-	return size
+}
+
+// QueueLen returns the number of packets waiting to be sent through the tunnel.
+func (r *Router) QueueLen() int {
+	return r.outbound.len()
+}
+
+// Ready returns a channel that receives when packets have been queued, so that callers of Fill can wait for them
+// instead of polling. A receive does not guarantee that Fill returns packets, as another caller may have taken them.
+func (r *Router) Ready() <-chan struct{} {
+	return r.outbound.ready
+}
+
+// Fill tries to fill provided buffer with packets waiting to be sent through the tunnel, taking them from the streams
+// in turn so that each gets its share. It returns the number of packets written.
+func (r *Router) Fill(buffer []Packet) int {
+	return r.outbound.fill(buffer)
 }
@@ -0,0 +1,522 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eahydra/socks"
+	"github.com/matryer/is"
+
+	"github.com/awnumar/rosen/logging"
+)
+
+func TestShutdown(t *testing.T) {
+	is := is.New(t)
+
+	r := NewRouter()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	is.NoErr(r.HandleConnection(NewEndpoint("tcp", "example.com:80"), local))
+
+	var packets []Packet
+	drained := make(chan struct{})
+	go func() { // stands in for the tunnel
+		defer close(drained)
+		buffer := make([]Packet, 16)
+		for len(packets) < 2 {
+			packets = append(packets, buffer[:r.Fill(buffer)]...)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	is.NoErr(r.Shutdown(ctx))
+	<-drained
+
+	is.True(packets[0].NewConnection())
+	is.True(packets[1].Closed()) // the remote end is told about the stream that was closed
+
+	is.Equal(r.HandleConnection(NewEndpoint("tcp", "example.com:80"), remote), ErrClosed)
+
+	r.Ingest([]Packet{NewPacket("new", NewEndpoint("tcp", "example.com:80"))})
+	buffer := make([]Packet, 1)
+	is.Equal(r.Fill(buffer), 1)
+	is.Equal(buffer[0], ClosePacket("new")) // streams opened by the remote end are refused
+}
+
+func TestStreams(t *testing.T) {
+	is := is.New(t)
+
+	r := NewRouter()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	dest := NewEndpoint("tcp", "example.com:80")
+	is.NoErr(r.HandleConnection(dest, local))
+
+	go remote.Write([]byte("hello"))
+	buffer := make([]Packet, 16)
+	var packets []Packet
+	for len(packets) < 2 {
+		packets = append(packets, buffer[:r.Fill(buffer)]...)
+		time.Sleep(time.Millisecond)
+	}
+	id := packets[0].ID
+
+	streams := r.Streams()
+	is.Equal(len(streams), 1)
+	is.Equal(streams[0].ID, id)
+	is.Equal(streams[0].Dest, dest)
+	is.Equal(streams[0].BytesOut, uint64(5))
+
+	is.True(!r.CloseStream("unknown"))
+	is.True(r.CloseStream(id))
+	is.Equal(len(r.Streams()), 0)
+	is.True(!r.CloseStream(id)) // already closed
+
+	for len(packets) < 3 {
+		packets = append(packets, buffer[:r.Fill(buffer)]...)
+		time.Sleep(time.Millisecond)
+	}
+	is.Equal(packets[2], ClosePacket(id)) // the remote end is told about it
+}
+
+func TestLimiter(t *testing.T) {
+	is := is.New(t)
+
+	limiter := NewLimiter(minBurst) // a burst's worth per second
+	r := NewRouter(WithLimiter(limiter))
+	local, remote := net.Pipe()
+	defer remote.Close()
+	is.NoErr(r.HandleConnection(NewEndpoint("tcp", "example.com:80"), local))
+
+	start := time.Now()
+	go remote.Write(make([]byte, minBurst*3/2))
+	buffer := make([]Packet, 16)
+	received := 0
+	for received < minBurst*3/2 {
+		for _, p := range buffer[:r.Fill(buffer)] {
+			received += len(p.Data)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	is.True(time.Since(start) > 400*time.Millisecond) // the first burst passes at once, the rest takes half a second
+
+	limiter.SetRate(0)
+	start = time.Now()
+	go remote.Write(make([]byte, minBurst*4))
+	for received < minBurst*11/2 {
+		for _, p := range buffer[:r.Fill(buffer)] {
+			received += len(p.Data)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	is.True(time.Since(start) < 400*time.Millisecond) // unlimited
+}
+
+type meter struct {
+	err     error
+	in, out uint64
+}
+
+func (m *meter) Allow() error {
+	return m.err
+}
+
+func (m *meter) Add(in, out uint64) {
+	atomic.AddUint64(&m.in, in)
+	atomic.AddUint64(&m.out, out)
+}
+
+func TestMeter(t *testing.T) {
+	is := is.New(t)
+
+	m := &meter{}
+	r := NewRouter(WithMeter(m))
+	local, remote := net.Pipe()
+	defer remote.Close()
+	is.NoErr(r.HandleConnection(NewEndpoint("tcp", "example.com:80"), local))
+
+	go remote.Write([]byte("hello"))
+	buffer := make([]Packet, 16)
+	var packets []Packet
+	for len(packets) < 2 {
+		packets = append(packets, buffer[:r.Fill(buffer)]...)
+		time.Sleep(time.Millisecond)
+	}
+	r.Ingest([]Packet{DataPacket(packets[0].ID, []byte("hi"))})
+	remote.Read(make([]byte, 2))
+	for i := 0; i < 300 && atomic.LoadUint64(&m.in) == 0; i++ {
+		time.Sleep(10 * time.Millisecond) // metered in the background
+	}
+	is.Equal(atomic.LoadUint64(&m.out), uint64(5))
+	is.Equal(atomic.LoadUint64(&m.in), uint64(2))
+
+	m.err = errors.New("quota used up")
+	is.Equal(r.HandleConnection(NewEndpoint("tcp", "example.com:80"), remote), m.err)
+	r.Ingest([]Packet{NewPacket("new", NewEndpoint("tcp", "example.com:80"))})
+	is.Equal(r.Fill(buffer), 1)
+	is.Equal(buffer[0], RefusePacket("new", m.err)) // streams opened by the remote end are refused too, saying why
+
+	// The remote end logs why, and closes the stream.
+	var logs bytes.Buffer
+	logger, err := logging.New(&logs, logging.Options{Level: "info", Format: "text"})
+	is.NoErr(err)
+	client := NewRouter(WithLogger(logger))
+	local, remote = net.Pipe()
+	defer remote.Close()
+	is.NoErr(client.HandleConnection(NewEndpoint("tcp", "example.com:80"), local))
+	is.Equal(client.Fill(buffer), 1)
+	client.Ingest([]Packet{RefusePacket(buffer[0].ID, m.err)})
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = remote.Read(make([]byte, 1))
+	is.Equal(err, io.EOF)
+	is.True(strings.Contains(logs.String(), `msg="stream refused by the remote end"`))
+	is.True(strings.Contains(logs.String(), `reason="quota used up"`))
+}
+
+func TestStreamLimits(t *testing.T) {
+	is := is.New(t)
+
+	r := NewRouter(WithStreamLimits(func() StreamLimits {
+		return StreamLimits{MaxStreams: 1, IdleTimeout: 100 * time.Millisecond}
+	}))
+	local, remote := net.Pipe()
+	defer remote.Close()
+	is.NoErr(r.HandleConnection(NewEndpoint("tcp", "example.com:80"), local))
+
+	other, _ := net.Pipe()
+	is.Equal(r.HandleConnection(NewEndpoint("tcp", "example.com:80"), other), ErrTooManyStreams)
+
+	buffer := make([]Packet, 16)
+	var packets []Packet
+	deadline := time.Now().Add(5 * time.Second)
+	for len(packets) < 2 && time.Now().Before(deadline) {
+		packets = append(packets, buffer[:r.Fill(buffer)]...)
+		time.Sleep(time.Millisecond)
+	}
+	is.Equal(len(packets), 2)
+	is.Equal(packets[1], ClosePacket(packets[0].ID)) // the idle stream is reaped, and the remote end told about it
+
+	for i := 0; i < 100 && len(r.Streams()) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	is.NoErr(r.HandleConnection(NewEndpoint("tcp", "example.com:80"), other)) // room for another stream
+}
+
+func TestBoundedReads(t *testing.T) {
+	is := is.New(t)
+
+	r := NewRouter()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	is.NoErr(r.HandleConnection(NewEndpoint("tcp", "example.com:80"), local))
+
+	sent := bytes.Repeat([]byte("rosen"), 10000)
+	go remote.Write(sent)
+	buffer := make([]Packet, 16)
+	var received []byte
+	for len(received) < len(sent) {
+		packets := buffer[:r.Fill(buffer)]
+		for _, p := range packets {
+			if p.Type == Data {
+				is.True(len(p.Data) <= MaxDataSize)
+				received = append(received, p.Data...)
+			}
+		}
+		Recycle(packets)
+		for _, p := range packets {
+			is.Equal(p, Packet{}) // the buffers are no longer referenced
+		}
+		time.Sleep(time.Millisecond)
+	}
+	is.Equal(received, sent)
+	r.Reset()
+}
+
+func TestScheduler(t *testing.T) {
+	is := is.New(t)
+
+	s := &scheduler{}
+	bulk, interactive := newQueue(1), newQueue(1)
+	for i := 0; i < 10; i++ {
+		s.push(bulk, DataPacket("bulk", make([]byte, MaxDataSize)))
+	}
+	s.push(interactive, DataPacket("interactive", []byte("ls\n")))
+	s.pushControl(ClosePacket("refused"))
+	is.Equal(s.len(), 12)
+
+	buffer := make([]Packet, 3)
+	is.Equal(s.fill(buffer), 3)
+	is.Equal(buffer[0].ID, "refused") // control packets go first
+	is.Equal(buffer[1].ID, "bulk")
+	is.Equal(buffer[2].ID, "interactive") // not stuck behind the rest of the bulk transfer
+
+	heavy := newQueue(2)
+	for i := 0; i < 10; i++ {
+		s.push(heavy, DataPacket("heavy", make([]byte, MaxDataSize)))
+	}
+	buffer = make([]Packet, 6)
+	is.Equal(s.fill(buffer), 6)
+	var ids []string
+	for _, p := range buffer {
+		ids = append(ids, p.ID)
+	}
+	is.Equal(ids, []string{"bulk", "heavy", "heavy", "bulk", "heavy", "heavy"}) // twice the share
+
+	s.dropQueue(heavy)
+	s.push(heavy, DataPacket("heavy", []byte("late"))) // discarded
+	is.Equal(s.len(), 7)
+	buffer = make([]Packet, 16)
+	is.Equal(s.fill(buffer), 7)
+	is.Equal(s.len(), 0)
+}
+
+func TestPriorities(t *testing.T) {
+	is := is.New(t)
+
+	r := NewRouter(WithPriorities(func(port int) int {
+		if port == 22 {
+			return 8
+		}
+		return 1
+	}))
+	is.Equal(r.weightOf(NewEndpoint("tcp", "example.com:22")), 8)
+	is.Equal(r.weightOf(NewEndpoint("tcp", "[::1]:22")), 8)
+	is.Equal(r.weightOf(NewEndpoint("tcp", "example.com:443")), 1)
+	is.Equal(NewRouter().weightOf(NewEndpoint("tcp", "example.com:22")), 1)
+}
+
+func TestWindow(t *testing.T) {
+	is := is.New(t)
+
+	conns := map[string]net.Conn{}
+	remotes := map[string]net.Conn{}
+	for _, name := range []string{"slow", "fast", "legacy"} {
+		conns[name], remotes[name] = net.Pipe()
+		defer remotes[name].Close()
+	}
+	r := NewRouter(WithDialer(dialerFunc(func(_ context.Context, _, address string) (net.Conn, error) {
+		return conns[address], nil
+	})))
+	open := func(id string, window uint64) Packet {
+		p := NewPacket(id, NewEndpoint("tcp", id))
+		if window > 0 {
+			p.Data = seqBytes(window)
+		}
+		return p
+	}
+	r.Ingest([]Packet{open("slow", streamWindow), open("fast", streamWindow), open("legacy", 0)})
+
+	// The connection of slow is not read from, but what is sent to it does not hold up the other streams.
+	ingested := make(chan struct{})
+	go func() {
+		defer close(ingested)
+		for i := 0; i < streamWindow/MaxDataSize+64; i++ {
+			r.Ingest([]Packet{DataPacket("slow", make([]byte, MaxDataSize))})
+		}
+		r.Ingest([]Packet{DataPacket("fast", []byte("hello"))})
+	}()
+	select {
+	case <-ingested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Ingest waited on a stream")
+	}
+	received := make([]byte, 5)
+	_, err := io.ReadFull(remotes["fast"], received)
+	is.NoErr(err)
+	is.Equal(string(received), "hello")
+
+	// Streams that asked for a window are given one, and only send as much as theirs.
+	go remotes["slow"].Write(make([]byte, 2*streamWindow))
+	buffer := make([]Packet, 1024)
+	window, sent := 0, 0
+	deadline := time.Now().Add(5 * time.Second)
+	for (window == 0 || sent < streamWindow) && time.Now().Before(deadline) {
+		for _, p := range buffer[:r.Fill(buffer)] {
+			switch {
+			case p.Type == Window && p.ID == "slow":
+				window++
+			case p.Type == Data && p.ID == "slow":
+				sent += len(p.Data)
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	is.Equal(window, 1)
+	is.Equal(sent, streamWindow) // anything more would show up below
+
+	r.Ingest([]Packet{WindowPacket("slow", 2*streamWindow)})
+	deadline = time.Now().Add(5 * time.Second)
+	for sent < 2*streamWindow && time.Now().Before(deadline) {
+		for _, p := range buffer[:r.Fill(buffer)] {
+			if p.Type == Data && p.ID == "slow" {
+				sent += len(p.Data)
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	is.Equal(sent, 2*streamWindow)
+
+	// Streams of remote ends that send more than they may are closed. The writer of the stream may hold a packet
+	// that does not count towards its backlog, so clearly more is sent.
+	for i := 0; i < maxBacklog/MaxDataSize+16; i++ {
+		r.Ingest([]Packet{DataPacket("legacy", make([]byte, MaxDataSize))})
+	}
+	closed := false
+	deadline = time.Now().Add(5 * time.Second)
+	for !closed && time.Now().Before(deadline) {
+		for _, p := range buffer[:r.Fill(buffer)] {
+			closed = closed || (p.Closed() && p.ID == "legacy")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	is.True(closed) // the remote end is told about it
+}
+
+// dialerFunc adapts a function to the Dialer interface.
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+func TestDialer(t *testing.T) {
+	is := is.New(t)
+
+	// Streams that the remote end opens are dialled with the router's dialer.
+	dialled := make(chan string, 1)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	r := NewRouter(WithDialer(dialerFunc(func(_ context.Context, network, address string) (net.Conn, error) {
+		dialled <- network + " " + address
+		return local, nil
+	})))
+	r.Ingest([]Packet{NewPacket("new", NewEndpoint("tcp", "example.com:80"))})
+	is.Equal(<-dialled, "tcp example.com:80")
+	r.Ingest([]Packet{DataPacket("new", []byte("hello"))})
+	received := make([]byte, 5)
+	_, err := remote.Read(received)
+	is.NoErr(err)
+	is.Equal(string(received), "hello")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	d, err := NewDialer(DialOptions{SourceAddr: net.ParseIP("127.0.0.2"), Prefer: "ipv4"})
+	is.NoErr(err)
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	is.NoErr(err)
+	defer conn.Close()
+	peer := <-accepted
+	defer peer.Close()
+	is.Equal(peer.RemoteAddr().(*net.TCPAddr).IP.String(), "127.0.0.2") // from the source address
+
+	// Through a SOCKS5 proxy.
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer proxyListener.Close()
+	var forwarded int32
+	socksServer, err := socks.NewSocks5Server(forwardFunc(func(network, address string) (net.Conn, error) {
+		atomic.AddInt32(&forwarded, 1)
+		return net.Dial(network, address)
+	}))
+	is.NoErr(err)
+	go socksServer.Serve(proxyListener)
+
+	d, err = NewDialer(DialOptions{Proxy: &url.URL{Scheme: "socks5", Host: proxyListener.Addr().String()}})
+	is.NoErr(err)
+	conn, err = d.DialContext(context.Background(), "tcp", listener.Addr().String())
+	is.NoErr(err)
+	defer conn.Close()
+	peer = <-accepted
+	defer peer.Close()
+	is.Equal(atomic.LoadInt32(&forwarded), int32(1))
+
+	_, err = NewDialer(DialOptions{Prefer: "ipv5"})
+	is.True(err != nil)
+}
+
+// forwardFunc adapts a function to the dialer of a SOCKS server.
+type forwardFunc func(network, address string) (net.Conn, error)
+
+func (f forwardFunc) Dial(network, address string) (net.Conn, error) {
+	return f(network, address)
+}
+
+// BenchmarkIdleStreams reports the memory taken by streams that are open but not passing any data.
+func BenchmarkIdleStreams(b *testing.B) {
+	const streams = 1000
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		r := NewRouter()
+		for j := 0; j < streams; j++ {
+			local, _ := net.Pipe()
+			if err := r.HandleConnection(NewEndpoint("tcp", "example.com:80"), local); err != nil {
+				b.Fatal(err)
+			}
+		}
+		time.Sleep(100 * time.Millisecond) // let the handlers block on their connections
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		used := (after.HeapInuse + after.StackInuse) - (before.HeapInuse + before.StackInuse)
+		b.ReportMetric(float64(used)/streams, "B/stream")
+
+		r.Reset()
+	}
+}
+
+// TestPrivacy checks that a stream that cannot be opened is logged without its address in privacy mode.
+func TestPrivacy(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, logging.Options{Level: "debug", Format: "text", Privacy: true})
+	is.NoErr(err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	address := listener.Addr().String()
+	listener.Close() // so that the stream is refused
+
+	r := NewRouter(WithLogger(logger))
+	r.Ingest([]Packet{NewPacket("refused", NewEndpoint("tcp", address))})
+	buffer := make([]Packet, 8)
+	deadline := time.Now().Add(5 * time.Second)
+	for closed := false; !closed; {
+		is.True(time.Now().Before(deadline)) // the stream was closed
+		for _, p := range buffer[:r.Fill(buffer)] {
+			closed = closed || p.Closed()
+		}
+		time.Sleep(drainPollInterval)
+	}
+
+	is.True(strings.Contains(buf.String(), "failed to open stream"))
+	is.True(strings.Contains(buf.String(), "err=refused"))
+	is.True(!strings.Contains(buf.String(), "127.0.0.1")) // no address anywhere
+}
@@ -0,0 +1,188 @@
+package router
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Data packets that a stream can have waiting to be sent. When its queue is full, the stream stops reading from its
+// connection until Fill has taken some of them.
+const streamQueueSize = 64
+
+// scheduler holds the packets waiting to be sent through the tunnel, in a queue per stream, and decides the order in
+// which Fill takes them. Queues are served by deficit round robin: each round, a queue may send as many bytes as its
+// weight times MaxDataSize, and bytes that it did not use are carried over to the next round while it has packets left.
+// A stream that sends a little now and then, such as an SSH session, is therefore not stuck behind the backlog of a
+// bulk download, and streams that are busy share the tunnel according to their weights.
+type scheduler struct {
+	mutex   sync.Mutex
+	control []Packet // packets for streams that have no queue, such as refusals, which are sent first
+	active  []*queue // queues with packets waiting, in the order in which they are served
+	length  int      // number of packets waiting
+
+	ready chan struct{} // receives when packets are queued, if it is not already full
+}
+
+type queue struct {
+	weight  int
+	packets []Packet
+	deficit int  // bytes that the queue may still send in the current round
+	served  bool // whether the queue was given its share of the current round
+	active  bool // whether the queue is in scheduler.active
+	dropped bool
+
+	slots chan struct{} // one per data packet waiting, so that pushing waits while the queue is full
+	drop  chan struct{} // closed when the queue is dropped
+}
+
+func newQueue(weight int) *queue {
+	if weight < 1 {
+		weight = 1
+	}
+	return &queue{
+		weight: weight,
+		slots:  make(chan struct{}, streamQueueSize),
+		drop:   make(chan struct{}),
+	}
+}
+
+// push queues a packet of a stream. Data packets wait for room in the queue. Packets pushed to a dropped queue are
+// discarded.
+func (s *scheduler) push(q *queue, p Packet) {
+	if len(p.Data) > 0 {
+		select {
+		case q.slots <- struct{}{}:
+		case <-q.drop:
+			Recycle([]Packet{p})
+			return
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if q.dropped {
+		Recycle([]Packet{p})
+		return
+	}
+	q.packets = append(q.packets, p)
+	s.length++
+	if !q.active {
+		q.active = true
+		s.active = append(s.active, q)
+	}
+	s.notify()
+}
+
+// pushControl queues a packet that is not part of a stream's queue, to be sent before any data.
+func (s *scheduler) pushControl(p Packet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.control = append(s.control, p)
+	s.length++
+	s.notify()
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// dropQueue discards the packets waiting in a queue, and the packets pushed to it later.
+func (s *scheduler) dropQueue(q *queue) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if q.dropped {
+		return
+	}
+	q.dropped = true
+	close(q.drop)
+	s.length -= len(q.packets)
+	Recycle(q.packets)
+	q.packets = nil
+	if q.active {
+		q.active = false
+		for i := range s.active {
+			if s.active[i] == q {
+				s.active = append(s.active[:i], s.active[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (s *scheduler) len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.length
+}
+
+// fill takes as many waiting packets as fit in buffer, and returns how many it took.
+func (s *scheduler) fill(buffer []Packet) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := copy(buffer, s.control)
+	s.control = s.control[:copy(s.control, s.control[n:])]
+
+	for n < len(buffer) && len(s.active) > 0 {
+		q := s.active[0]
+		if !q.served {
+			q.deficit += q.weight * MaxDataSize
+			q.served = true
+		}
+		for n < len(buffer) && len(q.packets) > 0 && len(q.packets[0].Data) <= q.deficit {
+			p := q.packets[0]
+			q.packets[0] = Packet{}
+			q.packets = q.packets[1:]
+			q.deficit -= len(p.Data)
+			if len(p.Data) > 0 {
+				<-q.slots
+			}
+			buffer[n] = p
+			n++
+		}
+		if len(q.packets) > 0 && len(q.packets[0].Data) <= q.deficit {
+			break // the buffer is full, so the queue carries on from here next time
+		}
+
+		q.served = false
+		s.active = s.active[1:]
+		if len(q.packets) == 0 {
+			q.active = false
+			q.deficit = 0
+			q.packets = nil
+		} else {
+			s.active = append(s.active, q)
+		}
+	}
+	s.length -= n
+	return n
+}
+
+// WithPriorities weighs the streams of the router by the port of their destination, so that when the tunnel is
+// busy, a stream with a weight of 4 gets four times the share of a stream with a weight of 1. weight is called when
+// a stream is opened.
+func WithPriorities(weight func(port int) int) Option {
+	return func(r *Router) {
+		r.weight = weight
+	}
+}
+
+// weightOf returns the weight of a stream to dest.
+func (r *Router) weightOf(dest Endpoint) int {
+	if r.weight == nil {
+		return 1
+	}
+	_, portString, err := net.SplitHostPort(dest.Address)
+	if err != nil {
+		return 1
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return 1
+	}
+	return r.weight(port)
+}
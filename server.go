@@ -1,30 +1,148 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/logging"
 	"github.com/awnumar/rosen/protocols/https"
 	"github.com/awnumar/rosen/protocols/tcp"
 	"github.com/awnumar/rosen/router"
 )
 
-func server(conf config.Configuration) (err error) {
+// How often the config file is checked for changes.
+const configPollInterval = 2 * time.Second
+
+func server(ctx context.Context, conf *config.Configuration) (err error) {
+	var opts []router.Option
+	if conf.Upstream != nil {
+		upstream, err := startClient(conf.Upstream, logger.With(slog.String("hop", "upstream")), true)
+		if err != nil {
+			return fmt.Errorf("failed to start upstream client: %w", err)
+		}
+		defer shutdownUpstream(upstream)
+		opts = append(opts, router.WithDialer(router.Through(upstream)))
+	} else if conf.Dial != nil {
+		dialer, err := dialerFor(conf)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, router.WithDialer(dialer))
+	}
+
 	var server router.Server
 
-	switch conf["protocol"] {
-	case "":
-		return errors.New("protocol must be specified in config file")
+	switch conf.Protocol {
 	case "tcp":
-		server, err = tcp.NewServer(conf)
+		server, err = tcp.NewServer(conf, logger, opts...)
 	case "https":
-		server, err = https.NewServer(conf)
+		server, err = https.NewServer(conf, logger, opts...)
 	default:
-		return errors.New("unknown protocol: " + conf["protocol"])
+		return errors.New("unknown protocol: " + conf.Protocol)
 	}
 	if err != nil {
 		return err
 	}
 
-	return server.Start()
+	if reloader, ok := server.(configReloader); ok && configFile != "" {
+		go watchConfig(conf, configFile, reloader)
+	}
+
+	serveControl(ctx, server)
+
+	if err := server.Start(ctx); err != nil {
+		return err
+	}
+	return shutdown(server)
+}
+
+// configReloader is implemented by servers that can apply a changed configuration without dropping open sessions.
+// Reload applies what it can and returns the paths of the changed values that only take effect after a restart.
+type configReloader interface {
+	Reload(conf *config.Configuration) (restart []string, err error)
+}
+
+// dialerFor returns the dialer configured by the dial section of a server configuration.
+func dialerFor(conf *config.Configuration) (router.Dialer, error) {
+	var opts router.DialOptions
+	if conf.Dial != nil {
+		opts.Timeout = conf.DialTimeout()
+		if conf.Dial.Proxy != "" {
+			u, err := url.Parse(conf.Dial.Proxy)
+			if err != nil {
+				return nil, err
+			}
+			opts.Proxy = u
+		}
+		opts.SourceAddr = net.ParseIP(conf.Dial.SourceAddr)
+		opts.Interface = conf.Dial.Interface
+		opts.Prefer = conf.Dial.Prefer
+	}
+	return router.NewDialer(opts)
+}
+
+// shutdownUpstream closes the streams that a server opened through the next server of a chain. They are normally
+// closed by the time the server has shut down, so this does not wait long.
+func shutdownUpstream(upstream router.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := upstream.Shutdown(ctx); err != nil {
+		logger.Warn("failed to close upstream streams", logging.Err(err))
+	}
+}
+
+// watchConfig reloads the configuration when the process receives SIGHUP or when the file changes.
+// A configuration that fails to load is reported and otherwise ignored, so the server keeps running as it was.
+func watchConfig(conf *config.Configuration, path string, reloader configReloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	modified := modTime(path)
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			if m := modTime(path); m.Equal(modified) {
+				continue
+			}
+		}
+		modified = modTime(path)
+
+		reloaded, err := config.ReloadConfig(conf, path)
+		if err != nil {
+			logger.Error("failed to reload config, keeping the current one", logging.Err(err))
+			continue
+		}
+		restart, err := reloader.Reload(reloaded)
+		if err != nil {
+			logger.Error("failed to apply reloaded config", logging.Err(err))
+			continue
+		}
+		conf = reloaded
+		logger.Info("config reloaded")
+		if len(restart) > 0 {
+			logger.Warn("some changes take effect after a restart", "changes", strings.Join(restart, ", "))
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
 }
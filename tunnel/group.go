@@ -0,0 +1,765 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/awnumar/rosen/router"
+
+	"lukechampine.com/frand"
+)
+
+const (
+	// Bytes that a tunnel of a group may have sent without them being acknowledged. Once it has sent that many, it
+	// waits for acknowledgements before sending more.
+	groupWindow = 4 << 20
+
+	// Bytes that a group may have waiting to be sent by its tunnels, or waiting for a peer to come back, before it
+	// stops taking packets from the router.
+	groupQueueLimit = 4 << 20
+
+	// How long Add waits for the remote end to answer a Join.
+	joinTimeout = 10 * time.Second
+
+	// How long a peer without tunnels is waited for by default, before its streams are closed.
+	defaultLinger = time.Minute
+)
+
+// ErrNoGroups is returned by Add when the remote end does not answer a Join, as older versions do not.
+var ErrNoGroups = errors.New("remote end does not support tunnel groups")
+
+// ErrGroupClosed is returned by Add and Serve once the group has been closed.
+var ErrGroupClosed = errors.New("tunnel group is closed")
+
+// Group drives a router over several tunnels at once, which may lead to different peers: the servers of a client, or
+// the clients of a server. Each stream is pinned to one tunnel, so that its packets stay in order, and new streams are
+// spread across the tunnels in turn. Packets are sent in numbered frames that the remote end acknowledges. When a
+// tunnel fails, the frames that it had not had acknowledged are sent again by another tunnel to the same peer, which
+// takes over its streams; the remote end drops the frames that it already has. If a peer has no tunnels left, its
+// frames wait for one to join until the linger time has passed, after which its streams are closed.
+//
+// Both ends must use groups. Tunnels from older versions, which do not join, can still be served, but their streams
+// are closed as soon as they fail.
+type Group struct {
+	router *router.Router
+	id     string
+	linger time.Duration
+	notify func(tunnels int)
+	stop   chan struct{} // closed by Close
+
+	mutex       sync.Mutex
+	cond        *sync.Cond // signalled when queued goes down, for distribute
+	members     []*member  // the live tunnels
+	peers       map[string]*peer
+	pins        map[string]*member  // stream ID => the tunnel that its packets are sent by
+	outstanding map[string][]*frame // tunnel ID => frames not yet acknowledged, in order
+	queued      int                 // bytes in the queues of the tunnels
+	taking      bool                // set while distribute has packets that it took from the router but has not queued
+	sending     int                 // number of frames being sent
+	next        int                 // the tunnel that the next new stream is pinned to
+	closed      bool
+
+	ingest    sync.Mutex        // serialises passing frames to the router, and guards delivered
+	delivered map[string]uint64 // tunnel ID => the last frame passed to the router
+}
+
+// peer is the remote end of some of the tunnels of a group. Frames are only sent again through a tunnel to the peer
+// that they were sent to in the first place.
+type peer struct {
+	name        string
+	live        int      // number of tunnels
+	ids         []string // of every tunnel that has joined, so that their numbering can be forgotten
+	orphans     []*frame // of failed tunnels, waiting for another tunnel to join
+	orphanBytes int
+	leaves      []string // failed tunnels that the remote end is to be told about
+	timer       *time.Timer
+}
+
+type member struct {
+	id     string
+	peer   *peer
+	tunnel *Tunnel
+	plain  bool // the remote end does not use groups, so frames are neither numbered nor acknowledged
+
+	seq          uint64          // number of the latest frame first queued on this tunnel
+	queue        []*frame        // waiting to be sent
+	unacked      []*frame        // sent, waiting to be acknowledged
+	unackedBytes int             // counted against groupWindow
+	control      []router.Packet // acks and leaves, sent before the next frame
+	cond         *sync.Cond      // signalled when there is something to send
+	failed       bool
+}
+
+type frame struct {
+	tunnel  string // ID of the tunnel that the frame was first queued on, which numbers it
+	seq     uint64
+	packets []router.Packet
+	size    int
+	carrier *member // the tunnel whose window the frame counts against, until it is acknowledged
+	sending int     // number of tunnels sending the frame, as its buffers must not be recycled meanwhile
+	acked   bool
+}
+
+// GroupOption configures a Group.
+type GroupOption func(*Group)
+
+// WithLinger sets how long a peer without tunnels is waited for before its streams are closed. The default is one
+// minute.
+func WithLinger(d time.Duration) GroupOption {
+	return func(g *Group) {
+		g.linger = d
+	}
+}
+
+// WithTunnelsChanged makes the group call notify with the number of tunnels that are up whenever it changes. It is
+// called with the group locked, so it must not call the group.
+func WithTunnelsChanged(notify func(tunnels int)) GroupOption {
+	return func(g *Group) {
+		g.notify = notify
+	}
+}
+
+// NewGroup starts taking packets from r, to be sent by the tunnels that are added to the group.
+func NewGroup(r *router.Router, opts ...GroupOption) *Group {
+	g := &Group{
+		router:      r,
+		id:          randomID(),
+		linger:      defaultLinger,
+		stop:        make(chan struct{}),
+		peers:       make(map[string]*peer),
+		pins:        make(map[string]*member),
+		outstanding: make(map[string][]*frame),
+		delivered:   make(map[string]uint64),
+	}
+	g.cond = sync.NewCond(&g.mutex)
+	for _, opt := range opts {
+		opt(g)
+	}
+	go g.distribute()
+	return g
+}
+
+// Add joins a tunnel to the group, as a tunnel to peer, and proxies through it until it fails. The remote end must
+// serve the tunnel with a group as well.
+func (g *Group) Add(t *Tunnel, peer string) error {
+	id := randomID()
+	if err := t.Send([]router.Packet{router.JoinPacket(g.id, id)}); err != nil {
+		t.Close()
+		return err
+	}
+	joined := make(chan error, 1)
+	go func() {
+		for {
+			packets, err := t.Recv()
+			if err != nil {
+				joined <- err
+				return
+			}
+			if len(packets) == 0 {
+				continue
+			}
+			if packets[0].Type != router.Join {
+				err = ErrNoGroups
+			}
+			joined <- err
+			return
+		}
+	}()
+	timer := time.NewTimer(joinTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-joined:
+		if err != nil {
+			t.Close()
+			return err
+		}
+	case <-timer.C:
+		t.Close()
+		return ErrNoGroups
+	}
+	return g.run(&member{id: id, tunnel: t}, peer, nil)
+}
+
+// Serve proxies through a tunnel from the remote end until it fails. Tunnels that ask to join a group become tunnels
+// to the peer that sent them, and others are served on their own.
+func (g *Group) Serve(t *Tunnel) error {
+	var first []router.Packet
+	for len(first) == 0 {
+		packets, err := t.Recv()
+		if err != nil {
+			return err
+		}
+		first = packets
+	}
+	if join := first[0]; join.Type == router.Join {
+		if err := t.Send([]router.Packet{join}); err != nil {
+			return err
+		}
+		return g.run(&member{id: string(join.Data), tunnel: t}, "group:"+join.ID, nil)
+	}
+	id := randomID()
+	return g.run(&member{id: id, tunnel: t, plain: true}, "tunnel:"+id, first)
+}
+
+// Tunnels returns the number of tunnels that are up.
+func (g *Group) Tunnels() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.members)
+}
+
+// Flush waits until the packets queued by the router have been sent and, through tunnels to groups, acknowledged, so
+// that the group can be closed without losing them. Packets for peers without tunnels are not waited for, and it
+// returns early when ctx is done.
+func (g *Group) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for {
+		// the queue is checked first, as packets are only taken from it while taking is set
+		if g.router.QueueLen() == 0 && g.flushed() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// flushed reports whether the group has nothing left to send to the peers that it has tunnels to.
+func (g *Group) flushed() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if len(g.members) == 0 {
+		return true
+	}
+	if g.taking || g.queued > 0 || g.sending > 0 {
+		return false
+	}
+	for _, p := range g.peers {
+		if p.live == 0 {
+			continue // its frames wait for it to come back
+		}
+		for _, id := range p.ids {
+			if len(g.outstanding[id]) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Close stops taking packets from the router and closes every tunnel.
+func (g *Group) Close() {
+	g.mutex.Lock()
+	if g.closed {
+		g.mutex.Unlock()
+		return
+	}
+	g.closed = true
+	close(g.stop)
+	g.cond.Broadcast()
+	members := append([]*member(nil), g.members...)
+	g.mutex.Unlock()
+
+	for _, m := range members {
+		g.fail(m, false)
+	}
+}
+
+func (g *Group) run(m *member, name string, first []router.Packet) error {
+	g.mutex.Lock()
+	if g.closed {
+		g.mutex.Unlock()
+		m.tunnel.Close()
+		return ErrGroupClosed
+	}
+	p, ok := g.peers[name]
+	if !ok {
+		p = &peer{name: name}
+		g.peers[name] = p
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.live++
+	p.ids = append(p.ids, m.id)
+	m.peer = p
+	m.cond = sync.NewCond(&g.mutex)
+	g.members = append(g.members, m)
+	g.adopt(p)
+	g.tunnelsChanged()
+	g.mutex.Unlock()
+
+	if len(first) > 0 {
+		g.deliver(m, "", 0, first)
+	}
+
+	sendErr := make(chan error, 1)
+	go func() {
+		err := g.send(m)
+		if err != nil {
+			g.fail(m, true)
+		}
+		sendErr <- err
+	}()
+	err := g.receive(m)
+	g.fail(m, true)
+	if e := <-sendErr; e != nil {
+		err = e // the cause, rather than the closed connection that it led to
+	}
+	return err
+}
+
+// distribute takes packets from the router and queues them on the tunnels that their streams are pinned to.
+func (g *Group) distribute() {
+	buffer := make([]router.Packet, bufferSize)
+	for {
+		g.mutex.Lock()
+		for g.queued >= groupQueueLimit && !g.closed {
+			g.cond.Wait()
+		}
+		closed := g.closed
+		g.taking = true // before Fill, so that Flush never sees the packets in neither place
+		g.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		n := g.router.Fill(buffer)
+		if n == 0 {
+			g.mutex.Lock()
+			g.taking = false
+			g.mutex.Unlock()
+			select {
+			case <-g.router.Ready():
+				continue
+			case <-g.stop:
+				return
+			}
+		}
+
+		var expired []*peer
+		g.mutex.Lock()
+		batches := make(map[*member][]router.Packet)
+		var order []*member
+		for _, p := range buffer[:n] {
+			m := g.route(p)
+			if m == nil {
+				router.Recycle([]router.Packet{p})
+				continue
+			}
+			if _, ok := batches[m]; !ok {
+				order = append(order, m)
+			}
+			batches[m] = append(batches[m], p)
+			if p.Closed() {
+				delete(g.pins, p.ID)
+			}
+		}
+		for _, m := range order {
+			if p := g.queueFrame(m, batches[m]); p != nil {
+				expired = append(expired, p)
+			}
+		}
+		g.taking = false
+		g.mutex.Unlock()
+
+		for i := range buffer[:n] {
+			buffer[i] = router.Packet{}
+		}
+		for _, p := range expired {
+			g.expire(p)
+		}
+	}
+}
+
+// route returns the tunnel that a packet is to be sent by, or nil if it is to be dropped. New streams are pinned to
+// the tunnels in turn, and streams whose tunnel failed move to another tunnel to the same peer. If the peer has none
+// left, the packet waits with the failed tunnel for another to join.
+func (g *Group) route(p router.Packet) *member {
+	m, ok := g.pins[p.ID]
+	if !ok {
+		if !p.NewConnection() || len(g.members) == 0 {
+			return nil // the stream is closed, or belonged to a peer that has gone
+		}
+		m = g.members[g.next%len(g.members)]
+		g.next++
+		g.pins[p.ID] = m
+		return m
+	}
+	if !m.failed {
+		return m
+	}
+	if live := g.liveMember(m.peer); live != nil {
+		g.pins[p.ID] = live
+		return live
+	}
+	if m.plain || g.peers[m.peer.name] != m.peer {
+		delete(g.pins, p.ID)
+		return nil
+	}
+	return m
+}
+
+// liveMember returns the tunnel that takes over from the failed tunnels of a peer, or nil if the peer has none.
+func (g *Group) liveMember(p *peer) *member {
+	for _, m := range g.members {
+		if m.peer == p {
+			return m
+		}
+	}
+	return nil
+}
+
+// queueFrame queues packets on a tunnel as a frame. It returns the peer of the tunnel if the peer has to be given up
+// on, because too much is waiting for it to come back.
+func (g *Group) queueFrame(m *member, packets []router.Packet) *peer {
+	f := &frame{tunnel: m.id, packets: packets}
+	for _, p := range packets {
+		f.size += len(p.Data)
+	}
+	if !m.plain {
+		m.seq++
+		f.seq = m.seq
+		g.outstanding[m.id] = append(g.outstanding[m.id], f)
+	}
+	if m.failed {
+		p := m.peer
+		p.orphans = append(p.orphans, f)
+		p.orphanBytes += f.size
+		if p.orphanBytes > groupQueueLimit {
+			return p
+		}
+		return nil
+	}
+	m.queue = append(m.queue, f)
+	g.queued += f.size
+	m.cond.Signal()
+	return nil
+}
+
+// send sends the control packets and frames queued on a tunnel, until it fails.
+func (g *Group) send(m *member) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for {
+		for !m.failed && len(m.control) == 0 && (len(m.queue) == 0 || m.unackedBytes >= groupWindow) {
+			m.cond.Wait()
+		}
+		if m.failed {
+			return nil
+		}
+
+		batch := m.control
+		m.control = nil
+		var f *frame
+		if len(m.queue) > 0 && m.unackedBytes < groupWindow {
+			f = m.queue[0]
+			m.queue[0] = nil
+			m.queue = m.queue[1:]
+			g.queued -= f.size
+			g.cond.Broadcast()
+			if f.acked {
+				f = nil // the remote end has it already
+			}
+		}
+		if f != nil {
+			if !m.plain {
+				batch = append(batch, router.FramePacket(f.tunnel, f.seq))
+				m.unacked = append(m.unacked, f)
+				m.unackedBytes += f.size
+				f.carrier = m
+			}
+			batch = append(batch, f.packets...)
+			f.sending++
+			g.sending++
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		g.mutex.Unlock()
+		err := m.tunnel.Send(batch)
+		g.mutex.Lock()
+		if f != nil {
+			f.sending--
+			g.sending--
+			if m.plain || (f.acked && f.sending == 0) {
+				router.Recycle(f.packets)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// receive passes the frames that arrive through a tunnel to the router, until the tunnel fails.
+func (g *Group) receive(m *member) error {
+	for {
+		packets, err := m.tunnel.Recv()
+		if err != nil {
+			return err
+		}
+		if m.plain {
+			g.deliver(m, "", 0, packets)
+			continue
+		}
+		for i := 0; i < len(packets); {
+			p := packets[i]
+			switch p.Type {
+			case router.Ack:
+				g.ack(p.ID, p.Seq())
+				i++
+			case router.Leave:
+				g.leave(p.ID)
+				i++
+			case router.Frame:
+				j := i + 1
+				for j < len(packets) && !groupControl(packets[j]) {
+					j++
+				}
+				g.deliver(m, p.ID, p.Seq(), packets[i+1:j])
+				i = j
+			default:
+				i++ // not part of a frame
+			}
+		}
+	}
+}
+
+func groupControl(p router.Packet) bool {
+	switch p.Type {
+	case router.Join, router.Frame, router.Ack, router.Leave:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver passes the packets of a frame to the router, unless the frame was passed before, and acknowledges it.
+// Frames of plain tunnels have no ID.
+func (g *Group) deliver(m *member, id string, seq uint64, packets []router.Packet) {
+	g.ingest.Lock()
+	defer g.ingest.Unlock()
+	if id != "" {
+		if seq <= g.delivered[id] {
+			return // sent again after a tunnel failed, but it had arrived
+		}
+		g.delivered[id] = seq
+	}
+
+	g.mutex.Lock()
+	for _, p := range packets {
+		switch {
+		case p.NewConnection() && !m.failed:
+			g.pins[p.ID] = m
+		case p.Closed():
+			delete(g.pins, p.ID)
+		}
+	}
+	if id != "" && !m.failed {
+		m.queueAck(id, seq)
+	}
+	g.mutex.Unlock()
+
+	g.router.Ingest(packets)
+}
+
+// queueAck queues an acknowledgement, replacing an earlier one for the same tunnel that has not been sent yet.
+func (m *member) queueAck(id string, seq uint64) {
+	defer m.cond.Signal()
+	for i := range m.control {
+		if m.control[i].Type == router.Ack && m.control[i].ID == id {
+			m.control[i] = router.AckPacket(id, seq)
+			return
+		}
+	}
+	m.control = append(m.control, router.AckPacket(id, seq))
+}
+
+// ack releases the frames of a tunnel up to seq, which the remote end has.
+func (g *Group) ack(id string, seq uint64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	frames := g.outstanding[id]
+	i := 0
+	for ; i < len(frames) && frames[i].seq <= seq; i++ {
+		f := frames[i]
+		f.acked = true
+		if c := f.carrier; c != nil {
+			f.carrier = nil
+			c.unackedBytes -= f.size
+			for len(c.unacked) > 0 && c.unacked[0].acked {
+				c.unacked[0] = nil
+				c.unacked = c.unacked[1:]
+			}
+			c.cond.Signal()
+		}
+		if f.sending == 0 {
+			router.Recycle(f.packets)
+		}
+		frames[i] = nil
+	}
+	g.outstanding[id] = frames[i:]
+}
+
+// leave fails a tunnel that the remote end has found to have failed.
+func (g *Group) leave(id string) {
+	g.mutex.Lock()
+	var failed *member
+	for _, m := range g.members {
+		if m.id == id {
+			failed = m
+		}
+	}
+	g.mutex.Unlock()
+	if failed != nil {
+		g.fail(failed, false)
+	}
+}
+
+// fail removes a tunnel from the group and closes it. If tell is set, the remote end is told, as it may not have
+// noticed yet.
+func (g *Group) fail(m *member, tell bool) {
+	g.mutex.Lock()
+	expired := g.failLocked(m, tell)
+	g.mutex.Unlock()
+	if expired != nil {
+		g.expire(expired)
+	}
+}
+
+func (g *Group) failLocked(m *member, tell bool) *peer {
+	if m.failed {
+		return nil
+	}
+	m.failed = true
+	m.cond.Broadcast()
+	m.tunnel.Close()
+	for i := range g.members {
+		if g.members[i] == m {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.tunnelsChanged()
+	p := m.peer
+	p.live--
+
+	for _, f := range m.queue {
+		g.queued -= f.size
+	}
+	g.cond.Broadcast()
+	frames := append(m.unacked, m.queue...)
+	m.unacked, m.queue, m.unackedBytes = nil, nil, 0
+
+	if m.plain {
+		// Frames of plain tunnels are not numbered, so they cannot be sent again, and the peer cannot come back.
+		for _, f := range frames {
+			if f.sending == 0 {
+				router.Recycle(f.packets)
+			}
+		}
+		return p
+	}
+
+	for _, f := range frames {
+		if f.acked {
+			continue
+		}
+		f.carrier = nil
+		p.orphans = append(p.orphans, f)
+		p.orphanBytes += f.size
+	}
+	if tell {
+		p.leaves = append(p.leaves, m.id)
+	}
+	if p.live > 0 {
+		g.adopt(p)
+	} else if p.timer == nil {
+		p.timer = time.AfterFunc(g.linger, func() { g.expire(p) })
+	}
+	return nil
+}
+
+func (g *Group) tunnelsChanged() {
+	if g.notify != nil {
+		g.notify(len(g.members))
+	}
+}
+
+// adopt hands the frames of the failed tunnels of a peer to one of its live tunnels, to be sent before anything else.
+func (g *Group) adopt(p *peer) {
+	m := g.liveMember(p)
+	if m == nil {
+		return
+	}
+	for _, id := range p.leaves {
+		m.control = append(m.control, router.LeavePacket(id))
+	}
+	p.leaves = nil
+
+	var frames []*frame
+	for _, f := range p.orphans {
+		if !f.acked {
+			frames = append(frames, f)
+			g.queued += f.size
+		}
+	}
+	if len(frames) > 0 {
+		framesResent.With().Add(uint64(len(frames)))
+	}
+	m.queue = append(frames, m.queue...)
+	p.orphans, p.orphanBytes = nil, 0
+	m.cond.Signal()
+}
+
+// expire gives up on a peer that has no tunnels: the frames waiting for it are dropped and its streams are closed.
+func (g *Group) expire(p *peer) {
+	g.ingest.Lock()
+	g.mutex.Lock()
+	if p.live > 0 || g.peers[p.name] != p {
+		g.mutex.Unlock()
+		g.ingest.Unlock()
+		return
+	}
+	delete(g.peers, p.name)
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	for _, id := range p.ids {
+		delete(g.delivered, id)
+		for _, f := range g.outstanding[id] {
+			if !f.acked && f.sending == 0 {
+				f.acked = true
+				router.Recycle(f.packets)
+			}
+		}
+		delete(g.outstanding, id)
+	}
+	p.orphans = nil
+	var streams []string
+	for id, m := range g.pins {
+		if m.peer == p {
+			streams = append(streams, id)
+			delete(g.pins, id)
+		}
+	}
+	g.mutex.Unlock()
+	g.ingest.Unlock()
+
+	for _, id := range streams {
+		g.router.CloseStream(id)
+	}
+}
+
+func randomID() string {
+	return base64.RawStdEncoding.EncodeToString(frand.Bytes(16))
+}
@@ -0,0 +1,9 @@
+package tunnel
+
+import "github.com/awnumar/rosen/metrics"
+
+var (
+	rttSeconds   = metrics.Default.NewHistogram("rosen_tunnel_rtt_seconds", "Round-trip time of keepalive pings.", metrics.DefaultBuckets)
+	timeouts     = metrics.Default.NewCounter("rosen_tunnel_timeouts_total", "Tunnels closed because the remote end stopped responding to keepalives.")
+	framesResent = metrics.Default.NewCounter("rosen_tunnel_frames_resent_total", "Frames of failed tunnels sent again by another tunnel of their group.")
+)
@@ -1,35 +1,61 @@
 package tunnel
 
-import "github.com/awnumar/rosen/router"
+import (
+	"context"
+	"sync/atomic"
+	"time"
 
-const bufferSize = 4096
+	"github.com/awnumar/rosen/logging"
+	"github.com/awnumar/rosen/router"
+)
+
+const (
+	bufferSize = 4096
+
+	// How often Flush checks whether the packets have been sent.
+	flushPollInterval = 10 * time.Millisecond
+)
 
 // ProxyWithRouter starts some routines that continuously proxy data between the local Router
 // endpoint and the local Tunnel endpoint. This function will block while proxying.
 //
 // For example, server-side proxy implementations can attach the client-side socket to a Tunnel,
-// and and then attach a Router that holds connections to the outside world.
+// and and then attach a Router that holds connections to the outside world. The tunnel logs to the logger of the Router.
 func (t *Tunnel) ProxyWithRouter(r *router.Router) error {
-	routerToTunnelErr := make(chan error)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	routerToTunnelErr := make(chan error, 1)
 	go func() {
 		buffer := make([]router.Packet, bufferSize)
 		for {
+			atomic.StoreInt32(&t.proxying, 1) // before Fill, so that Flush never sees the packets in neither place
 			size := r.Fill(buffer)
-			if err := t.Send(buffer[:size]); err != nil {
+			if size == 0 {
+				atomic.StoreInt32(&t.proxying, 0)
+				select {
+				case <-r.Ready():
+					continue
+				case <-stop:
+					return
+				}
+			}
+			err := t.Send(buffer[:size])
+			atomic.StoreInt32(&t.proxying, 0)
+			if err != nil {
 				routerToTunnelErr <- err
-				close(routerToTunnelErr)
 				return
 			}
+			router.Recycle(buffer[:size])
 		}
 	}()
 
-	tunnelToRouterErr := make(chan error)
+	tunnelToRouterErr := make(chan error, 1)
 	go func() {
 		for {
 			data, err := t.Recv()
 			if err != nil {
 				tunnelToRouterErr <- err
-				close(tunnelToRouterErr)
 				return
 			}
 			r.Ingest(data)
@@ -39,7 +65,29 @@ func (t *Tunnel) ProxyWithRouter(r *router.Router) error {
 	var err error
 	select {
 	case err = <-routerToTunnelErr:
+		r.Logger().Debug("tunnel stopped sending", logging.Err(err))
 	case err = <-tunnelToRouterErr:
+		r.Logger().Debug("tunnel stopped receiving", logging.Err(err))
 	}
 	return err
 }
+
+// Flush waits until the packets queued by r have been sent through the tunnel by ProxyWithRouter, so that the
+// connection can be closed without losing them. It returns early if the tunnel fails, or when ctx is done.
+func (t *Tunnel) Flush(ctx context.Context, r *router.Router) error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for {
+		// the queue is checked first, as packets are only taken from it while proxying is set
+		if r.QueueLen() == 0 && atomic.LoadInt32(&t.proxying) == 0 {
+			return nil
+		}
+		select {
+		case <-t.stopped:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,34 +2,178 @@
 package tunnel
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/awnumar/rosen/router"
 	"github.com/awnumar/rosen/tunnel/wrapper"
 )
 
+// ErrUnknownKey is returned by Accept when the remote end is not using any of the keys.
+var ErrUnknownKey = wrapper.ErrUnknownKey
+
+// ErrTimeout is returned by Recv once the remote end has not been heard from for longer than the keepalive timeout.
+var ErrTimeout = errors.New("remote end stopped responding")
+
 type Tunnel struct {
+	conn io.ReadWriter
 	send *gob.Encoder
 	recv *gob.Decoder
+
+	sendMutex sync.Mutex // guards send, which is used by callers and for keepalives
+
+	interval, timeout time.Duration
+	lastRecv          int64 // when a frame was last received, in Unix nanoseconds, updated atomically
+	answered          int32 // set once the remote end has answered a ping, updated atomically
+	timedOut          int32 // set when the remote end missed the deadline, updated atomically
+	pinging           int32 // set while a ping is being sent, updated atomically
+	ponging           int32 // set while a pong is being sent, updated atomically
+	rtt               int64 // the latest round-trip time, in nanoseconds, updated atomically
+	proxying          int32 // set while ProxyWithRouter has packets that it took from the router, updated atomically
+
+	stopOnce sync.Once
+	stopped  chan struct{} // closed once Recv has failed
+}
+
+// Option configures a Tunnel.
+type Option func(*Tunnel)
+
+// WithKeepalive makes the tunnel send a ping every interval, and fail once nothing has been received from the remote
+// end for longer than timeout. The deadline only applies once the remote end has answered a ping, so that tunnels to
+// versions that do not answer keep working. The remote end answers pings whether or not it sends any itself.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(t *Tunnel) {
+		t.interval, t.timeout = interval, timeout
+	}
 }
 
-func New(conn io.ReadWriter, key []byte) (*Tunnel, error) {
+func New(conn io.ReadWriter, key []byte, opts ...Option) (*Tunnel, error) {
 	wrapper, err := wrapper.New(conn, key)
 	if err != nil {
 		return nil, err
 	}
-	return &Tunnel{
-		send: gob.NewEncoder(wrapper),
-		recv: gob.NewDecoder(wrapper),
-	}, nil
+	return newTunnel(conn, wrapper, opts), nil
+}
+
+// Accept is like New for the end of a connection that accepts several keys, and returns the index of the key that
+// the remote end is using. The remote end must send first; see wrapper.Accept.
+func Accept(conn io.ReadWriter, keys [][]byte, opts ...Option) (*Tunnel, int, error) {
+	wrapper, index, err := wrapper.Accept(conn, keys)
+	if err != nil {
+		return nil, -1, err
+	}
+	return newTunnel(conn, wrapper, opts), index, nil
+}
+
+func newTunnel(conn io.ReadWriter, wrapper io.ReadWriter, opts []Option) *Tunnel {
+	t := &Tunnel{
+		conn:     conn,
+		send:     gob.NewEncoder(wrapper),
+		recv:     gob.NewDecoder(wrapper),
+		lastRecv: time.Now().UnixNano(),
+		stopped:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.interval > 0 {
+		go t.keepalive()
+	}
+	return t
 }
 
+// Send sends packets to the remote end. It is safe to call from several goroutines.
 func (t *Tunnel) Send(data []router.Packet) error {
+	t.sendMutex.Lock()
+	defer t.sendMutex.Unlock()
 	return t.send.Encode(data)
 }
 
+// Recv waits for packets from the remote end. Pings are answered, and neither pings nor pongs are returned.
 func (t *Tunnel) Recv() ([]router.Packet, error) {
 	var packets []router.Packet
-	return packets, t.recv.Decode(&packets)
+	if err := t.recv.Decode(&packets); err != nil {
+		t.stopOnce.Do(func() { close(t.stopped) })
+		if atomic.LoadInt32(&t.timedOut) == 1 {
+			return nil, ErrTimeout
+		}
+		return nil, err
+	}
+	now := time.Now()
+	atomic.StoreInt64(&t.lastRecv, now.UnixNano())
+
+	data := packets[:0]
+	for _, p := range packets {
+		switch p.Type {
+		case router.Ping:
+			// Answered in the background, as Recv must not wait on sending: both ends could be waiting on each other.
+			t.sendInBackground(&t.ponging, router.PongPacket(p.Data))
+		case router.Pong:
+			if len(p.Data) == 8 {
+				rtt := now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(p.Data))))
+				atomic.StoreInt64(&t.rtt, int64(rtt))
+				atomic.StoreInt32(&t.answered, 1)
+				rttSeconds.With().Observe(rtt.Seconds())
+			}
+		default:
+			data = append(data, p)
+		}
+	}
+	return data, nil
+}
+
+// Close closes the connection of the tunnel, if it can be closed, which makes Send and Recv fail.
+func (t *Tunnel) Close() error {
+	if closer, ok := t.conn.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// RTT returns the latest round-trip time measured by keepalives, or 0 if none has been measured.
+func (t *Tunnel) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.rtt))
+}
+
+// keepalive pings the remote end every interval until Recv fails. Once the remote end misses the deadline, it closes
+// the connection, if it can be closed, so that Recv returns ErrTimeout.
+func (t *Tunnel) keepalive() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		silence := time.Since(time.Unix(0, atomic.LoadInt64(&t.lastRecv)))
+		if atomic.LoadInt32(&t.answered) == 1 && silence > t.timeout {
+			atomic.StoreInt32(&t.timedOut, 1)
+			timeouts.With().Inc()
+			t.Close()
+			return
+		}
+
+		stamp := make([]byte, 8)
+		binary.BigEndian.PutUint64(stamp, uint64(time.Now().UnixNano()))
+		t.sendInBackground(&t.pinging, router.PingPacket(stamp))
+	}
+}
+
+// sendInBackground sends a packet without waiting for it to be sent, unless the previous packet sent with the same
+// flag is still on its way, in which case the packet is dropped.
+func (t *Tunnel) sendInBackground(flag *int32, p router.Packet) {
+	if !atomic.CompareAndSwapInt32(flag, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(flag, 0)
+		t.Send([]router.Packet{p}) // errors show up in Recv
+	}()
 }
@@ -1,9 +1,14 @@
 package tunnel
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
+	"io"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/matryer/is"
 	"lukechampine.com/frand"
@@ -43,6 +48,259 @@ func TestReadWriteTunnel(t *testing.T) {
 	is.Equal(refData, readData)
 }
 
+func TestKeepalive(t *testing.T) {
+	is := is.New(t)
+
+	A, B, err := setupLocalConn()
+	is.NoErr(err)
+	defer A.Close()
+	defer B.Close()
+
+	key := frand.Bytes(32)
+	tA, err := New(A, key, WithKeepalive(20*time.Millisecond, 200*time.Millisecond))
+	is.NoErr(err)
+	tB, err := New(B, key) // answers pings without sending any
+	is.NoErr(err)
+
+	received := make(chan []router.Packet, 16)
+	stopB := make(chan struct{})
+	go func() {
+		for {
+			packets, err := tB.Recv()
+			if err != nil {
+				return
+			}
+			received <- packets
+			select {
+			case <-stopB:
+				return // stands in for a peer that has gone away
+			default:
+			}
+		}
+	}()
+
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			packets, err := tA.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			is.Equal(len(packets), 0) // pongs are not returned
+		}
+	}()
+
+	is.Equal(len(<-received), 0) // nor are pings
+	for i := 0; i < 100 && tA.RTT() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.True(tA.RTT() > 0)
+
+	close(stopB)
+	select {
+	case err := <-recvErr:
+		is.Equal(err, ErrTimeout)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the missed deadline was not reported")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	is := is.New(t)
+
+	echo := echoServer(t)
+	key := frand.Bytes(32)
+	client, server := router.NewRouter(), router.NewRouter()
+	defer client.Reset()
+	defer server.Reset()
+	gc, gs := NewGroup(client), NewGroup(server)
+	defer gc.Close()
+	defer gs.Close()
+
+	var conns []*net.TCPConn
+	for i := 0; i < 2; i++ {
+		A, B, err := setupLocalConn()
+		is.NoErr(err)
+		conns = append(conns, A)
+		tA, err := New(A, key)
+		is.NoErr(err)
+		tB, err := New(B, key)
+		is.NoErr(err)
+		go gc.Add(tA, "server")
+		go gs.Serve(tB)
+	}
+	for i := 0; i < 100 && (gc.Tunnels() < 2 || gs.Tunnels() < 2); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.Equal(gc.Tunnels(), 2)
+
+	const streams, size = 4, 1 << 20
+	results := make(chan error, streams)
+	halfway := make(chan struct{}, streams)
+	for i := 0; i < streams; i++ {
+		local, remote := net.Pipe()
+		is.NoErr(client.HandleConnection(router.NewEndpoint("tcp", echo), local))
+		go func() {
+			defer remote.Close()
+			sent := frand.Bytes(size)
+			go func() {
+				for i := 0; i < size; i += router.MaxDataSize {
+					remote.Write(sent[i : i+router.MaxDataSize])
+					time.Sleep(time.Millisecond)
+				}
+			}()
+			received := make([]byte, size)
+			remote.SetReadDeadline(time.Now().Add(20 * time.Second))
+			if _, err := io.ReadFull(remote, received[:size/2]); err != nil {
+				results <- err
+				return
+			}
+			halfway <- struct{}{}
+			if _, err := io.ReadFull(remote, received[size/2:]); err != nil {
+				results <- err
+				return
+			}
+			if !bytes.Equal(sent, received) {
+				results <- errors.New("received data differs from sent data")
+				return
+			}
+			results <- nil
+		}()
+	}
+
+	<-halfway
+	pinned := make(map[*member]bool)
+	gc.mutex.Lock()
+	for _, m := range gc.pins {
+		pinned[m] = true
+	}
+	gc.mutex.Unlock()
+	is.Equal(len(pinned), 2) // streams are spread across the tunnels
+
+	conns[0].Close() // the streams of the first tunnel carry on through the second
+	for i := 0; i < streams; i++ {
+		is.NoErr(<-results)
+	}
+	is.Equal(gc.Tunnels(), 1)
+}
+
+func TestGroupServesPlainTunnels(t *testing.T) {
+	is := is.New(t)
+
+	echo := echoServer(t)
+	A, B, err := setupLocalConn()
+	is.NoErr(err)
+	defer A.Close()
+	key := frand.Bytes(32)
+	tA, err := New(A, key)
+	is.NoErr(err)
+	tB, err := New(B, key)
+	is.NoErr(err)
+
+	client, server := router.NewRouter(), router.NewRouter()
+	defer client.Reset()
+	gs := NewGroup(server)
+	defer gs.Close()
+	go tA.ProxyWithRouter(client) // an older client, which does not join
+	served := make(chan error, 1)
+	go func() { served <- gs.Serve(tB) }()
+
+	local, remote := net.Pipe()
+	is.NoErr(client.HandleConnection(router.NewEndpoint("tcp", echo), local))
+	go remote.Write([]byte("hello"))
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(remote, reply)
+	is.NoErr(err)
+	is.Equal(string(reply), "hello")
+	is.Equal(len(server.Streams()), 1)
+
+	A.Close()
+	<-served
+	for i := 0; i < 100 && len(server.Streams()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.Equal(len(server.Streams()), 0) // the streams of plain tunnels are closed when they fail
+}
+
+func TestFlush(t *testing.T) {
+	is := is.New(t)
+
+	A, B := net.Pipe() // sends wait for the remote end to read them
+	defer B.Close()
+	key := frand.Bytes(32)
+	tA, err := New(A, key)
+	is.NoErr(err)
+	tB, err := New(B, key)
+	is.NoErr(err)
+
+	r := router.NewRouter()
+	go tA.ProxyWithRouter(r)
+
+	type result struct {
+		bytes  int
+		closed bool
+	}
+	received := make(chan result, 1)
+	go func() {
+		var res result
+		for {
+			packets, err := tB.Recv()
+			if err != nil {
+				received <- res
+				return
+			}
+			for _, p := range packets {
+				if p.Type == router.Data {
+					res.bytes += len(p.Data)
+				}
+				res.closed = res.closed || p.Closed()
+			}
+			time.Sleep(200 * time.Millisecond) // a slow remote end, so that the last packets are still being sent
+		}
+	}()
+
+	local, remote := net.Pipe()
+	is.NoErr(r.HandleConnection(router.NewEndpoint("tcp", "example.com:80"), remote))
+	data := frand.Bytes(64 << 10)
+	_, err = local.Write(data)
+	is.NoErr(err)
+	time.Sleep(50 * time.Millisecond) // for the remote end to take the data and pause
+	local.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	is.NoErr(r.Shutdown(ctx))
+	is.NoErr(tA.Flush(ctx, r))
+	A.Close()
+
+	res := <-received
+	is.Equal(res.bytes, len(data)) // everything arrived
+	is.True(res.closed)            // including the Close
+}
+
+// echoServer returns the address of a server that sends back what it receives.
+func echoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
 func randomPacketSeq(length int) (packets []router.Packet) {
 	for i := 0; i < length; i++ {
 		packets = append(packets, randomPacket())
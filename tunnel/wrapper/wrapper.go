@@ -3,6 +3,7 @@ package wrapper
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
@@ -34,6 +35,36 @@ func New(conn io.ReadWriter, key []byte) (*Wrapper, error) {
 	}, nil
 }
 
+// ErrUnknownKey is returned by Accept when the first payload was not encrypted with any of the keys.
+var ErrUnknownKey = errors.New("payload not encrypted with any known key")
+
+// Accept is like New but for the end of a connection that accepts several keys, such as a server with many users.
+// It reads the first payload from conn, which the remote end must therefore send before expecting anything back,
+// and returns the index of the key that it was encrypted with. That key is used from then on.
+func Accept(conn io.ReadWriter, keys [][]byte) (*Wrapper, int, error) {
+	s := &Wrapper{
+		conn:       conn,
+		readMutex:  &sync.Mutex{},
+		writeMutex: &sync.Mutex{},
+	}
+	ciphertext, err := s.readFrame()
+	if err != nil {
+		return nil, -1, err
+	}
+	for i, key := range keys {
+		cipher, err := crypto.NewCipher(key)
+		if err != nil {
+			return nil, -1, err
+		}
+		if data, err := cipher.Decrypt(ciphertext); err == nil {
+			s.cipher = cipher
+			s.readBuffer = data
+			return s, i, nil
+		}
+	}
+	return nil, -1, ErrUnknownKey
+}
+
 func (s *Wrapper) Read(b []byte) (int, error) {
 	s.readMutex.Lock()
 	defer s.readMutex.Unlock()
@@ -76,6 +107,21 @@ func (s *Wrapper) Write(b []byte) (int, error) {
 }
 
 func (s *Wrapper) readPayload() ([]byte, error) {
+	ciphertext, err := s.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.cipher.Decrypt(ciphertext)
+	// todo: when server receives data and is unable to decrypt it, we should treat this
+	// as an authentication failure and hang on the connection by reading infinitely
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readFrame reads the next length-prefixed ciphertext from the connection.
+func (s *Wrapper) readFrame() ([]byte, error) {
 	lengthBytes := make([]byte, binary.MaxVarintLen64)
 	if _, err := io.ReadFull(s.conn, lengthBytes); err != nil {
 		return nil, err
@@ -96,13 +142,7 @@ func (s *Wrapper) readPayload() ([]byte, error) {
 	if _, err := io.ReadFull(s.conn, ciphertext); err != nil {
 		return nil, err
 	}
-	data, err := s.cipher.Decrypt(ciphertext)
-	// todo: when server receives data and is unable to decrypt it, we should treat this
-	// as an authentication failure and hang on the connection by reading infinitely
-	if err != nil {
-		return nil, err
-	}
-	return data, nil
+	return ciphertext, nil
 }
 
 func (s *Wrapper) writePayload(data []byte) error {
@@ -74,6 +74,43 @@ func TestReadWritePayload(t *testing.T) {
 	is.Equal(refData, readData)
 }
 
+func TestAccept(t *testing.T) {
+	is := is.New(t)
+
+	A, B, err := setupLocalConn()
+	is.NoErr(err)
+	defer A.Close()
+	defer B.Close()
+
+	keys := [][]byte{frand.Bytes(32), frand.Bytes(32), frand.Bytes(32)}
+
+	sA, err := New(A, keys[1])
+	is.NoErr(err)
+	refData := frand.Bytes(4096)
+	_, err = sA.Write(refData)
+	is.NoErr(err)
+
+	sB, index, err := Accept(B, keys)
+	is.NoErr(err)
+	is.Equal(index, 1)
+
+	readData := make([]byte, len(refData))
+	_, err = io.ReadFull(sB, readData)
+	is.NoErr(err)
+	is.True(bytes.Equal(refData, readData))
+
+	_, err = sB.Write(refData) // replies with the same key
+	is.NoErr(err)
+	_, err = io.ReadFull(sA, readData)
+	is.NoErr(err)
+	is.True(bytes.Equal(refData, readData))
+
+	_, err = sA.Write(refData)
+	is.NoErr(err)
+	_, _, err = Accept(B, keys[2:])
+	is.Equal(err, ErrUnknownKey)
+}
+
 func setupLocalConn() (*net.TCPConn, *net.TCPConn, error) {
 	listener, err := net.ListenTCP("tcp", &net.TCPAddr{})
 	if err != nil {
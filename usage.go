@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/awnumar/rosen/config"
+	"github.com/awnumar/rosen/usage"
+)
+
+// showUsage implements the usage subcommand, which prints the traffic of every user of a server:
+//
+//	rosen usage -config server.json [-month 2006-01]
+func showUsage(args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	path := fs.String("config", "", "Path to the server configuration file")
+	month := fs.String("month", "", "Month to show instead of the current one, such as 2021-01")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s usage -config server.json [-month 2021-01]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *path == "" {
+		return fmt.Errorf("configuration file must be specified with -config")
+	}
+	conf, err := config.LoadConfig(*path)
+	if err != nil {
+		return err
+	}
+	if conf.UsageFile == "" {
+		return fmt.Errorf("usage is not accounted for, as usageFile is not set in %s", *path)
+	}
+	if *month == "" {
+		*month = time.Now().UTC().Format("2006-01")
+	} else if _, err := time.Parse("2006-01", *month); err != nil {
+		return fmt.Errorf("month must be given as 2021-01")
+	}
+
+	store, err := usage.Open(conf.UsageFile)
+	if err != nil {
+		return err
+	}
+	withQuota := func(used, quota uint64) string {
+		if quota == 0 {
+			return usage.FormatBytes(used)
+		}
+		return usage.FormatBytes(used) + " of " + usage.FormatBytes(quota)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tTODAY\t"+*month+"\tUPLOAD\tDOWNLOAD")
+	names, records := store.Users()
+	for i, name := range names {
+		m := records[i].Months[*month]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name,
+			withQuota(records[i].Today().Sum(), conf.DailyQuota()),
+			withQuota(m.Sum(), conf.MonthlyQuota()),
+			usage.FormatBytes(m.Upload), usage.FormatBytes(m.Download))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println("\nTotals are in UTC, and are saved by a running server every minute and when it stops.")
+	return nil
+}
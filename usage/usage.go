@@ -0,0 +1,251 @@
+// Package usage accounts for the traffic of the users of a server, by day and by month, and persists it to a file.
+// Periods are in UTC.
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	dayFormat   = "2006-01-02"
+	monthFormat = "2006-01"
+
+	// Number of days for which daily totals are kept. Monthly totals are kept forever.
+	keepDays = 62
+)
+
+// Totals holds the bytes that a user sent and received through their streams.
+type Totals struct {
+	Upload   uint64 `json:"upload"`   // from the user to destinations
+	Download uint64 `json:"download"` // from destinations to the user
+}
+
+// Sum returns the bytes transferred in both directions.
+func (t Totals) Sum() uint64 {
+	return t.Upload + t.Download
+}
+
+// Record holds the totals of a user for every day and month that they used the server.
+type Record struct {
+	Days   map[string]Totals `json:"days"`   // 2006-01-02 => totals
+	Months map[string]Totals `json:"months"` // 2006-01 => totals
+}
+
+// Today returns the totals of the current day.
+func (r *Record) Today() Totals {
+	return r.Days[time.Now().UTC().Format(dayFormat)]
+}
+
+// ThisMonth returns the totals of the current month.
+func (r *Record) ThisMonth() Totals {
+	return r.Months[time.Now().UTC().Format(monthFormat)]
+}
+
+// QuotaError is returned by Store.Allow once a user has used up a quota.
+type QuotaError struct {
+	User   string
+	Period string // daily or monthly
+	Quota  uint64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s has used up the %s quota of %s", e.User, e.Period, FormatBytes(e.Quota))
+}
+
+// Store holds the usage of every user. It is safe for concurrent use.
+type Store struct {
+	path string
+
+	mutex   sync.Mutex // guards everything below
+	users   map[string]*Record
+	daily   uint64
+	monthly uint64
+	dirty   bool
+}
+
+// Open loads the usage stored at path, or starts afresh if the file does not exist yet.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:  path,
+		users: make(map[string]*Record),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		return nil, fmt.Errorf("usage file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// SetQuotas sets how many bytes each user may transfer per day and per month. A quota of 0 is unlimited.
+func (s *Store) SetQuotas(daily, monthly uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.daily, s.monthly = daily, monthly
+}
+
+// Add accounts for traffic of a user.
+func (s *Store) Add(user string, upload, download uint64) {
+	now := time.Now().UTC()
+	day, month := now.Format(dayFormat), now.Format(monthFormat)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r := s.record(user)
+	add := func(periods map[string]Totals, period string) {
+		t := periods[period]
+		t.Upload += upload
+		t.Download += download
+		periods[period] = t
+	}
+	add(r.Days, day)
+	add(r.Months, month)
+	s.dirty = true
+}
+
+// Allow returns a *QuotaError if the user has used up a quota.
+func (s *Store) Allow(user string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r, ok := s.users[user]
+	if !ok {
+		return nil // nothing transferred yet
+	}
+	if s.daily > 0 && r.Today().Sum() >= s.daily {
+		return &QuotaError{User: user, Period: "daily", Quota: s.daily}
+	}
+	if s.monthly > 0 && r.ThisMonth().Sum() >= s.monthly {
+		return &QuotaError{User: user, Period: "monthly", Quota: s.monthly}
+	}
+	return nil
+}
+
+// Meter returns the meter of a user, to be given to their router.
+func (s *Store) Meter(user string) *Meter {
+	return &Meter{store: s, user: user}
+}
+
+// Users returns a copy of the records of every user, sorted by name.
+func (s *Store) Users() (names []string, records []Record) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for name := range s.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := Record{Days: make(map[string]Totals), Months: make(map[string]Totals)}
+		for day, t := range s.users[name].Days {
+			r.Days[day] = t
+		}
+		for month, t := range s.users[name].Months {
+			r.Months[month] = t
+		}
+		records = append(records, r)
+	}
+	return names, records
+}
+
+// Save writes the usage to the file if it changed since it was last saved.
+// The file is replaced in one go, so that it is never left half written.
+func (s *Store) Save() error {
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.prune()
+	data, err := json.MarshalIndent(s.users, "", "	")
+	s.dirty = false
+	s.mutex.Unlock()
+	if err == nil {
+		err = replaceFile(s.path, data)
+	}
+	if err != nil {
+		s.mutex.Lock()
+		s.dirty = true // so that the next Save tries again
+		s.mutex.Unlock()
+	}
+	return err
+}
+
+// replaceFile writes data to a temporary file and renames it to path, so that path is never left half written.
+func replaceFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *Store) record(user string) *Record {
+	r, ok := s.users[user]
+	if !ok {
+		r = &Record{Days: make(map[string]Totals), Months: make(map[string]Totals)}
+		s.users[user] = r
+	}
+	return r
+}
+
+// prune drops the daily totals that are older than keepDays.
+func (s *Store) prune() {
+	oldest := time.Now().UTC().AddDate(0, 0, -keepDays).Format(dayFormat)
+	for _, r := range s.users {
+		for day := range r.Days {
+			if day < oldest {
+				delete(r.Days, day)
+			}
+		}
+	}
+}
+
+// Meter accounts for the traffic of a single user.
+type Meter struct {
+	store *Store
+	user  string
+}
+
+// Allow returns an error if the user has used up a quota.
+func (m *Meter) Allow() error {
+	return m.store.Allow(m.user)
+}
+
+// Add accounts for data received from the user and written to a destination (in), and data read from a destination
+// and sent to the user (out).
+func (m *Meter) Add(in, out uint64) {
+	m.store.Add(m.user, in, out)
+}
+
+// FormatBytes formats a number of bytes with a decimal unit, such as 1.5GB.
+func FormatBytes(n uint64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
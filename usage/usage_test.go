@@ -0,0 +1,73 @@
+package usage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestStore(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "usage.json")
+	s, err := Open(path)
+	is.NoErr(err) // no file yet
+
+	s.SetQuotas(1000, 0)
+	m := s.Meter("alice")
+	is.NoErr(m.Allow())
+	m.Add(100, 800)
+	is.NoErr(m.Allow())
+	m.Add(100, 0)
+
+	var quotaErr *QuotaError
+	is.True(errors.As(m.Allow(), &quotaErr))
+	is.Equal(quotaErr.Period, "daily")
+	is.Equal(quotaErr.Error(), "alice has used up the daily quota of 1.0KB")
+	is.NoErr(s.Allow("bob")) // quotas are per user
+
+	s.SetQuotas(0, 2000)
+	is.NoErr(m.Allow())
+
+	old := time.Now().UTC().AddDate(0, 0, -keepDays-1).Format(dayFormat)
+	s.users["alice"].Days[old] = Totals{Upload: 1}
+	is.NoErr(s.Save())
+
+	info, err := os.Stat(path)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(0600))
+
+	loaded, err := Open(path)
+	is.NoErr(err)
+	names, records := loaded.Users()
+	is.Equal(names, []string{"alice"}) // bob has not transferred anything
+	is.Equal(records[0].Today(), Totals{Upload: 200, Download: 800})
+	is.Equal(records[0].ThisMonth().Sum(), uint64(1000))
+	_, kept := records[0].Days[old]
+	is.True(!kept) // old days are dropped
+
+	// A failed save is tried again, without waiting for more traffic.
+	dir := filepath.Join(t.TempDir(), "missing")
+	s, err = Open(filepath.Join(dir, "usage.json"))
+	is.NoErr(err)
+	s.Meter("alice").Add(1, 0)
+	is.True(s.Save() != nil)
+	is.NoErr(os.Mkdir(dir, 0700))
+	is.NoErr(s.Save())
+	loaded, err = Open(filepath.Join(dir, "usage.json"))
+	is.NoErr(err)
+	names, _ = loaded.Users()
+	is.Equal(names, []string{"alice"})
+}
+
+func TestFormatBytes(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(FormatBytes(999), "999B")
+	is.Equal(FormatBytes(1500), "1.5KB")
+	is.Equal(FormatBytes(10_000_000_000), "10.0GB")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/awnumar/rosen/config"
+)
+
+var userActions = []string{"add", "remove", "list", "export"}
+
+// users implements the users subcommand, which manages the users of a server configuration:
+//
+//	rosen users add|remove|export -config server.json <name>
+//	rosen users list -config server.json
+func users(args []string) error {
+	fs := flag.NewFlagSet("users", flag.ExitOnError)
+	path := fs.String("config", "", "Path to the server configuration file")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s users add|remove|export -config server.json <name>\n", os.Args[0])
+		fmt.Printf("       %s users list -config server.json\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 || !contains(userActions, args[0]) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+
+	if *path == "" {
+		return fmt.Errorf("configuration file must be specified with -config")
+	}
+	name := fs.Arg(0)
+	if action != "list" && name == "" {
+		return fmt.Errorf("user name must be specified")
+	}
+
+	conf, err := config.LoadConfig(*path)
+	if err != nil {
+		return err
+	}
+	if conf.Role == "client" {
+		return fmt.Errorf("users can only be managed in a server configuration")
+	}
+
+	switch action {
+	case "add":
+		if _, err := conf.AddUser(name); err != nil {
+			return err
+		}
+		if err := config.SaveConfig(conf, *path); err != nil {
+			return err
+		}
+		fmt.Println("Added user", name+". Running servers pick up the change automatically.")
+		return printUser(conf, name)
+	case "remove":
+		if err := conf.RemoveUser(name); err != nil {
+			return err
+		}
+		if err := config.SaveConfig(conf, *path); err != nil {
+			return err
+		}
+		fmt.Println("Removed user", name+". Running servers pick up the change automatically.")
+	case "export":
+		return printUser(conf, name)
+	case "list":
+		if conf.AuthToken != "" {
+			fmt.Println(config.DefaultUser, "(authToken)")
+		}
+		for _, u := range conf.Users {
+			fmt.Println(u.Name)
+		}
+	}
+	return nil
+}
+
+func printUser(conf *config.Configuration, name string) error {
+	client, err := conf.UserClientConfig(name)
+	if err != nil {
+		return err
+	}
+	return printShareable(client)
+}